@@ -0,0 +1,187 @@
+package snitch
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+var (
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type BucketedHistogram interface {
+	Metric
+	Collector
+
+	Add(float64)
+	Buckets() []float64
+
+	With(...string) BucketedHistogram
+}
+
+type bucketedHistogramMetric struct {
+	Vector
+
+	mutex       sync.RWMutex
+	description *Description
+	upperBounds []float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+	min         float64
+	max         float64
+	mean        float64
+	m2          float64
+}
+
+func NewBucketedHistogram(name, help string, buckets []float64, labels ...string) BucketedHistogram {
+	upperBounds := normalizeBuckets(buckets)
+
+	metric := &bucketedHistogramMetric{
+		description: NewDescription(name, help, MetricTypeHistogram, labels...),
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+	metric.SetMetric(metric).SetCreator(func(l ...string) Metric {
+		return NewBucketedHistogram(name, help, upperBounds, append(labels, l...)...)
+	})
+
+	return metric
+}
+
+func LinearBuckets(start, width float64, count int) []float64 {
+	if count < 1 {
+		panic(errors.New("count of linear buckets can't be less than one"))
+	}
+
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start += width
+	}
+
+	return buckets
+}
+
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if count < 1 {
+		panic(errors.New("count of exponential buckets can't be less than one"))
+	}
+
+	if start <= 0 {
+		panic(errors.New("start of exponential buckets must be greater than zero"))
+	}
+
+	if factor <= 1 {
+		panic(errors.New("factor of exponential buckets must be greater than one"))
+	}
+
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+
+	return buckets
+}
+
+func (h *bucketedHistogramMetric) Description() *Description {
+	return h.description
+}
+
+func (h *bucketedHistogramMetric) Measure() (*MeasureValue, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	buckets := make(map[float64]*uint64, len(h.upperBounds)+1)
+
+	var cumulative uint64
+
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.counts[i]
+		buckets[upperBound] = Uint64(cumulative)
+	}
+
+	buckets[math.Inf(1)] = Uint64(h.count)
+
+	value := &MeasureValue{
+		SampleCount:    Uint64(h.count),
+		SampleSum:      Float64(h.sum),
+		SampleMin:      Float64(math.NaN()),
+		SampleMax:      Float64(math.NaN()),
+		SampleVariance: Float64(math.NaN()),
+		Quantiles:      map[float64]*float64{},
+		Buckets:        buckets,
+	}
+
+	if h.count > 0 {
+		value.SampleMin = Float64(h.min)
+		value.SampleMax = Float64(h.max)
+		value.SampleVariance = Float64(h.m2 / float64(h.count))
+	}
+
+	return value, nil
+}
+
+func (h *bucketedHistogramMetric) Add(value float64) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+
+	if h.count == 0 || value > h.max {
+		h.max = value
+	}
+
+	h.count++
+	h.sum += value
+
+	delta := value - h.mean
+	h.mean += delta / float64(h.count)
+	h.m2 += delta * (value - h.mean)
+}
+
+func (h *bucketedHistogramMetric) Buckets() []float64 {
+	return append([]float64(nil), h.upperBounds...)
+}
+
+func (h *bucketedHistogramMetric) With(labels ...string) BucketedHistogram {
+	return h.Vector.With(labels...).(BucketedHistogram)
+}
+
+func normalizeBuckets(buckets []float64) []float64 {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+
+	ret := make([]float64, 0, len(buckets))
+
+	for _, b := range buckets {
+		if math.IsNaN(b) || math.IsInf(b, 1) {
+			continue
+		}
+
+		ret = append(ret, b)
+	}
+
+	sort.Float64s(ret)
+
+	for i := 1; i < len(ret); i++ {
+		if ret[i] == ret[i-1] {
+			ret = append(ret[:i], ret[i+1:]...)
+			i--
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,120 @@
+package snitch
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBucketedHistogramBuckets(t *testing.T) {
+	h := NewBucketedHistogram("latency", "", []float64{1, 0.25, 0.5})
+
+	for _, value := range []float64{0.125, 0.25, 0.375, 0.5, 0.5, 1, 2} {
+		h.Add(value)
+	}
+
+	measure, err := h.Measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upper bounds are inclusive and counts are cumulative
+	expected := map[float64]uint64{
+		0.25:        2,
+		0.5:         5,
+		1:           6,
+		math.Inf(1): 7,
+	}
+
+	if len(measure.Buckets) != len(expected) {
+		t.Fatalf("%d buckets, expected %d", len(measure.Buckets), len(expected))
+	}
+
+	for le, count := range expected {
+		if v, ok := measure.Buckets[le]; !ok || *v != count {
+			t.Fatalf("bucket %v has %v, expected %d", le, measure.Buckets[le], count)
+		}
+	}
+
+	if *measure.Buckets[math.Inf(1)] != *measure.SampleCount {
+		t.Fatalf("+Inf bucket %d isn't equal to count %d", *measure.Buckets[math.Inf(1)], *measure.SampleCount)
+	}
+
+	if *measure.SampleSum != 4.75 || *measure.SampleMin != 0.125 || *measure.SampleMax != 2 {
+		t.Fatalf("unexpected sum %v, min %v and max %v", *measure.SampleSum, *measure.SampleMin, *measure.SampleMax)
+	}
+}
+
+func TestBucketedHistogramEmpty(t *testing.T) {
+	measure, err := NewBucketedHistogram("latency", "", []float64{1}).Measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *measure.SampleCount != 0 || *measure.Buckets[1] != 0 || *measure.Buckets[math.Inf(1)] != 0 {
+		t.Fatalf("unexpected measure of empty histogram %+v", measure)
+	}
+
+	if !math.IsNaN(*measure.SampleMin) || !math.IsNaN(*measure.SampleMax) {
+		t.Fatalf("min %v and max %v of empty histogram must be NaN", *measure.SampleMin, *measure.SampleMax)
+	}
+}
+
+func TestNormalizeBuckets(t *testing.T) {
+	tests := []struct {
+		buckets  []float64
+		expected []float64
+	}{
+		{nil, DefBuckets},
+		{[]float64{5, 1, 2.5}, []float64{1, 2.5, 5}},
+		{[]float64{1, 2, 1, 2, 2}, []float64{1, 2}},
+		{[]float64{math.Inf(1), 1, math.NaN(), math.Inf(-1)}, []float64{math.Inf(-1), 1}},
+	}
+
+	for _, test := range tests {
+		if result := normalizeBuckets(test.buckets); !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("normalized %v to %v, expected %v", test.buckets, result, test.expected)
+		}
+	}
+
+	// default buckets must not be changed by normalization
+	normalizeBuckets(nil)[0] = 100
+
+	if DefBuckets[0] != .005 {
+		t.Fatal("default buckets are changed")
+	}
+}
+
+func TestLinearAndExponentialBuckets(t *testing.T) {
+	if buckets := LinearBuckets(1, 0.5, 4); !reflect.DeepEqual(buckets, []float64{1, 1.5, 2, 2.5}) {
+		t.Fatalf("unexpected linear buckets %v", buckets)
+	}
+
+	if buckets := ExponentialBuckets(1, 2, 4); !reflect.DeepEqual(buckets, []float64{1, 2, 4, 8}) {
+		t.Fatalf("unexpected exponential buckets %v", buckets)
+	}
+}
+
+func TestBucketsPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{"linear count", func() { LinearBuckets(0, 1, 0) }},
+		{"exponential count", func() { ExponentialBuckets(1, 2, 0) }},
+		{"exponential start", func() { ExponentialBuckets(0, 2, 3) }},
+		{"exponential factor", func() { ExponentialBuckets(1, 1, 3) }},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: panic is expected", test.name)
+				}
+			}()
+
+			test.f()
+		}()
+	}
+}
@@ -1,6 +1,10 @@
 package snitch
 
 import (
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/pborman/uuid"
 )
 
@@ -12,6 +16,7 @@ const (
 	MetricTypeGauge
 	MetricTypeHistogram
 	MetricTypeTimer
+	MetricTypeMeter
 )
 
 var MetricTypeValue = [...]string{
@@ -20,23 +25,79 @@ var MetricTypeValue = [...]string{
 	"gauge",
 	"histogram",
 	"timer",
+	"meter",
+}
+
+// units recognized by suffix of name when description has no explicit unit
+var baseUnits = []string{
+	"seconds",
+	"bytes",
+	"ratio",
+	"volts",
+	"amperes",
+	"joules",
+	"grams",
+	"meters",
+	"celsius",
 }
 
 type Description struct {
-	id     string
-	name   string
-	help   string
-	typ    MetricType
-	labels Labels
+	id        string
+	name      string
+	help      string
+	unit      string
+	typ       MetricType
+	labels    Labels
+	createdAt time.Time
 }
 
 func NewDescription(name, help string, typ MetricType, labels ...string) *Description {
+	return NewDescriptionWithCreatedAt(name, help, typ, time.Now(), labels...)
+}
+
+// NewDescriptionWithCreatedAt restores description of metric created at the time,
+// such as description of measures read back from storage
+func NewDescriptionWithCreatedAt(name, help string, typ MetricType, createdAt time.Time, labels ...string) *Description {
+	return &Description{
+		id:        uuid.New(),
+		name:      name,
+		help:      help,
+		unit:      unitFromName(name),
+		typ:       typ,
+		labels:    Labels{}.With(labels...),
+		createdAt: createdAt,
+	}
+}
+
+// Relabel returns a copy of description with another name and labels,
+// labels are copied and sorted because relabel rules append them in any order.
+// Unit is kept because renaming doesn't change unit of values
+func (d *Description) Relabel(name string, labels Labels) *Description {
+	labels = append(Labels(nil), labels...)
+	sort.Sort(labels)
+
 	return &Description{
-		id:     uuid.New(),
-		name:   name,
-		help:   help,
-		typ:    typ,
-		labels: Labels{}.With(labels...),
+		id:        uuid.New(),
+		name:      name,
+		help:      d.help,
+		unit:      d.unit,
+		typ:       d.typ,
+		labels:    labels,
+		createdAt: d.createdAt,
+	}
+}
+
+// WithUnit returns a copy of description with the explicit unit instead of
+// the unit taken from suffix of name, the empty unit means values have no unit
+func (d *Description) WithUnit(unit string) *Description {
+	return &Description{
+		id:        uuid.New(),
+		name:      d.name,
+		help:      d.help,
+		unit:      unit,
+		typ:       d.typ,
+		labels:    d.labels,
+		createdAt: d.createdAt,
 	}
 }
 
@@ -52,6 +113,10 @@ func (d *Description) Help() string {
 	return d.help
 }
 
+func (d *Description) Unit() string {
+	return d.unit
+}
+
 func (d *Description) Type() MetricType {
 	return d.typ
 }
@@ -60,6 +125,22 @@ func (d *Description) Labels() Labels {
 	return d.labels
 }
 
+func (d *Description) CreatedAt() time.Time {
+	return d.createdAt
+}
+
 func (t MetricType) String() string {
 	return MetricTypeValue[t-1]
 }
+
+func unitFromName(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+
+	for _, unit := range baseUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,37 @@
+package snitch
+
+import (
+	"testing"
+)
+
+func TestDescriptionUnit(t *testing.T) {
+	tests := []struct {
+		description *Description
+		expected    string
+	}{
+		{NewDescription("latency_seconds", "", MetricTypeHistogram), "seconds"},
+		{NewDescription("received_bytes_total", "", MetricTypeCounter), "bytes"},
+		{NewDescription("requests_total", "", MetricTypeCounter), ""},
+		{NewDescription("seconds", "", MetricTypeGauge), ""},
+		{NewDescription("memory", "", MetricTypeGauge).WithUnit("bytes"), "bytes"},
+		{NewDescription("latency_seconds", "", MetricTypeHistogram).WithUnit(""), ""},
+		{NewDescription("latency_seconds", "", MetricTypeHistogram).Relabel("latency", nil), "seconds"},
+	}
+
+	for _, test := range tests {
+		if unit := test.description.Unit(); unit != test.expected {
+			t.Fatalf("unit of %s is %q, expected %q", test.description.Name(), unit, test.expected)
+		}
+	}
+
+	d := NewDescription("memory", "Memory", MetricTypeGauge, "host", "h")
+	explicit := d.WithUnit("bytes")
+
+	if explicit.ID() == d.ID() || explicit.Name() != d.Name() || explicit.Help() != d.Help() || explicit.Labels().String() != d.Labels().String() {
+		t.Fatal("copy with unit must have own id and the same name, help and labels")
+	}
+
+	if d.Unit() != "" {
+		t.Fatal("unit of source description is changed")
+	}
+}
@@ -0,0 +1,55 @@
+package snitch
+
+import (
+	"fmt"
+	"strings"
+)
+
+type CollectorError struct {
+	Descriptions []*Description
+	Err          error
+}
+
+func (e *CollectorError) Error() string {
+	names := make([]string, 0, len(e.Descriptions))
+
+	for _, d := range e.Descriptions {
+		names = append(names, d.Name())
+	}
+
+	return "collector of metrics [" + strings.Join(names, ", ") + "] failed because " + e.Err.Error()
+}
+
+func (e *CollectorError) Unwrap() error {
+	return e.Err
+}
+
+type MeasureError struct {
+	Description *Description
+	Err         error
+}
+
+func (e *MeasureError) Error() string {
+	return fmt.Sprintf("failed measure %s metric with labels %s because %v",
+		e.Description.Name(),
+		e.Description.Labels().Map(),
+		e.Err,
+	)
+}
+
+func (e *MeasureError) Unwrap() error {
+	return e.Err
+}
+
+type StorageError struct {
+	ID  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return "failed write to storage " + e.ID + " because " + e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
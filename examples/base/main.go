@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"time"
@@ -41,6 +42,13 @@ func main() {
 	expvarHandler()
 
 	time.Sleep(time.Second * 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := register.Close(ctx); err != nil {
+		fmt.Println(err.Error())
+	}
 }
 
 func expvarHandler() {
@@ -1,11 +1,16 @@
 package snitch
 
 import (
+	"time"
+
 	"github.com/kihamo/snitch/internal"
 )
 
 var (
 	Quantiles = []float64{0.5, 0.9, 0.99}
+
+	DefMaxAge     = 10 * time.Minute
+	DefAgeBuckets = 5
 )
 
 type Histogram interface {
@@ -23,6 +28,7 @@ type histogramMetric struct {
 
 	description *Description
 	histogram   *internal.SafeHistogram
+	window      *internal.WindowHistogram
 	quantiles   []float64
 }
 
@@ -47,25 +53,61 @@ func NewHistogramWithQuantiles(name, help string, quantiles []float64, labels ..
 	return metric
 }
 
+func NewHistogramWithWindow(name, help string, maxAge time.Duration, ageBuckets int, labels ...string) Histogram {
+	if maxAge <= 0 {
+		maxAge = DefMaxAge
+	}
+
+	if ageBuckets <= 0 {
+		ageBuckets = DefAgeBuckets
+	}
+
+	metric := &histogramMetric{
+		description: NewDescription(name, help, MetricTypeHistogram, labels...),
+		histogram:   internal.NewSafeHistogram(),
+		window:      internal.NewWindowHistogram(maxAge, ageBuckets),
+		quantiles:   Quantiles,
+	}
+	metric.SetMetric(metric).SetCreator(func(l ...string) Metric {
+		return NewHistogramWithWindow(name, help, maxAge, ageBuckets, append(labels, l...)...)
+	})
+
+	return metric
+}
+
 func (h *histogramMetric) Description() *Description {
 	return h.description
 }
 
 func (h *histogramMetric) Measure() (*MeasureValue, error) {
+	var quantiles map[float64]float64
+
+	if h.window != nil {
+		quantiles = h.window.Snapshot().Quantiles(h.quantiles)
+	}
+
 	h.histogram.RLock()
 	defer h.histogram.RUnlock()
 
+	if quantiles == nil {
+		quantiles = h.histogram.Quantiles(h.quantiles)
+	}
+
 	return &MeasureValue{
 		SampleCount:    Uint64(uint64(h.histogram.Count())),
 		SampleSum:      Float64(h.histogram.Sum()),
 		SampleMin:      Float64(h.histogram.Min()),
 		SampleMax:      Float64(h.histogram.Max()),
 		SampleVariance: Float64(h.histogram.Variance()),
-		Quantiles:      Float64Map(h.histogram.Quantiles(h.quantiles)),
+		Quantiles:      Float64Map(quantiles),
 	}, nil
 }
 
 func (h *histogramMetric) Add(value float64) {
+	if h.window != nil {
+		h.window.Add(value)
+	}
+
 	h.histogram.Lock()
 	defer h.histogram.Unlock()
 
@@ -73,6 +115,10 @@ func (h *histogramMetric) Add(value float64) {
 }
 
 func (h *histogramMetric) Quantile(q float64) float64 {
+	if h.window != nil {
+		return h.window.Snapshot().Quantile(q)
+	}
+
 	h.histogram.RLock()
 	defer h.histogram.RUnlock()
 
@@ -0,0 +1,38 @@
+package snitch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramWindow(t *testing.T) {
+	h := NewHistogramWithWindow("latency", "", 60*time.Millisecond, 3)
+
+	for i := 0; i < 10; i++ {
+		h.Add(100)
+	}
+
+	if q := h.Quantile(0.5); q != 100 {
+		t.Fatalf("median %v, expected 100", q)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		h.Add(1)
+	}
+
+	measure, err := h.Measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// quantiles cover the window only, while count and sum are cumulative
+	if *measure.Quantiles[0.5] != 1 || *measure.Quantiles[0.99] != 1 {
+		t.Fatalf("quantiles %v, %v of old values", *measure.Quantiles[0.5], *measure.Quantiles[0.99])
+	}
+
+	if *measure.SampleCount != 20 || *measure.SampleSum != 1010 || *measure.SampleMax != 100 {
+		t.Fatalf("count %d, sum %v and max %v aren't cumulative", *measure.SampleCount, *measure.SampleSum, *measure.SampleMax)
+	}
+}
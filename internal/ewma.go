@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EWMATickInterval = 5 * time.Second
+)
+
+type EWMA struct {
+	uncounted int64
+
+	mutex sync.RWMutex
+	alpha float64
+	rate  float64
+	init  bool
+}
+
+func NewEWMA(d time.Duration) *EWMA {
+	return &EWMA{
+		alpha: 1 - math.Exp(-EWMATickInterval.Seconds()/d.Seconds()),
+	}
+}
+
+func (e *EWMA) Update(n int64) {
+	atomic.AddInt64(&e.uncounted, n)
+}
+
+func (e *EWMA) Tick() {
+	instantRate := float64(atomic.SwapInt64(&e.uncounted, 0)) / EWMATickInterval.Seconds()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.init {
+		e.rate += e.alpha * (instantRate - e.rate)
+	} else {
+		e.rate = instantRate
+		e.init = true
+	}
+}
+
+func (e *EWMA) Rate() float64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.rate
+}
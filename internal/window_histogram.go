@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// WindowHistogram keeps several overlapping streams of observations, the oldest stream
+// is reset on every rotation so the head stream covers at most the last maxAge
+type WindowHistogram struct {
+	mutex sync.Mutex
+
+	streams      []*SafeHistogram
+	head         int
+	rotatePeriod time.Duration
+	rotateAt     time.Time
+}
+
+func NewWindowHistogram(maxAge time.Duration, ageBuckets int) *WindowHistogram {
+	if ageBuckets < 1 {
+		ageBuckets = 1
+	}
+
+	streams := make([]*SafeHistogram, ageBuckets)
+	for i := range streams {
+		streams[i] = NewSafeHistogram()
+	}
+
+	rotatePeriod := maxAge / time.Duration(ageBuckets)
+
+	return &WindowHistogram{
+		streams:      streams,
+		rotatePeriod: rotatePeriod,
+		rotateAt:     time.Now().Add(rotatePeriod),
+	}
+}
+
+func (w *WindowHistogram) Add(value float64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.rotate(time.Now())
+
+	for _, s := range w.streams {
+		s.Lock()
+		s.Add(value)
+		s.Unlock()
+	}
+}
+
+func (w *WindowHistogram) Snapshot() *SafeHistogram {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.rotate(time.Now())
+
+	return w.streams[w.head].Copy()
+}
+
+func (w *WindowHistogram) rotate(now time.Time) {
+	if w.rotatePeriod <= 0 {
+		return
+	}
+
+	if expired := w.rotateAt.Add(w.rotatePeriod * time.Duration(len(w.streams)-1)); !now.Before(expired) {
+		for i := range w.streams {
+			w.streams[i] = NewSafeHistogram()
+		}
+
+		w.head = 0
+		w.rotateAt = now.Add(w.rotatePeriod)
+
+		return
+	}
+
+	for !now.Before(w.rotateAt) {
+		w.streams[w.head] = NewSafeHistogram()
+		w.head = (w.head + 1) % len(w.streams)
+		w.rotateAt = w.rotateAt.Add(w.rotatePeriod)
+	}
+}
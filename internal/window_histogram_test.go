@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowHistogramRotate(t *testing.T) {
+	w := NewWindowHistogram(time.Minute, 3)
+	start := w.rotateAt.Add(-w.rotatePeriod)
+
+	add := func(value float64, count int) {
+		for i := 0; i < count; i++ {
+			w.Add(value)
+		}
+	}
+
+	check := func(step string, count int, median float64) {
+		snapshot := w.Snapshot()
+
+		if c := snapshot.Count(); c != count {
+			t.Fatalf("%s: %d values in window, expected %d", step, c, count)
+		}
+
+		if count > 0 && snapshot.Quantile(0.5) != median {
+			t.Fatalf("%s: median %v, expected %v", step, snapshot.Quantile(0.5), median)
+		}
+	}
+
+	add(100, 10)
+	check("initial", 10, 100)
+
+	w.rotate(start.Add(w.rotatePeriod))
+	add(1, 10)
+	check("first rotation", 20, 1)
+
+	w.rotate(start.Add(2 * w.rotatePeriod))
+	check("second rotation", 20, 1)
+
+	// values older than maxAge are gone
+	w.rotate(start.Add(3 * w.rotatePeriod))
+	check("third rotation", 10, 1)
+
+	w.rotate(start.Add(10 * w.rotatePeriod))
+	check("expired", 0, 0)
+}
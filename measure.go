@@ -21,6 +21,11 @@ type MeasureValue struct {
 	SampleMax      *float64
 	SampleVariance *float64
 	Quantiles      map[float64]*float64
+	Buckets        map[float64]*uint64
+	Rate1          *float64
+	Rate5          *float64
+	Rate15         *float64
+	RateMean       *float64
 }
 
 func (m Measures) Len() int {
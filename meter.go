@@ -0,0 +1,137 @@
+package snitch
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/kihamo/snitch/internal"
+)
+
+type Meter interface {
+	Metric
+	Collector
+
+	Mark(int64)
+	Count() int64
+	Rate1() float64
+	Rate5() float64
+	Rate15() float64
+	RateMean() float64
+
+	With(...string) Meter
+}
+
+type meterMetric struct {
+	count    int64
+	lastTick int64
+
+	Vector
+
+	description *Description
+	begin       time.Time
+	rate1       *internal.EWMA
+	rate5       *internal.EWMA
+	rate15      *internal.EWMA
+}
+
+func NewMeter(name, help string, labels ...string) Meter {
+	begin := time.Now()
+
+	metric := &meterMetric{
+		lastTick:    begin.UnixNano(),
+		description: NewDescription(name, help, MetricTypeMeter, labels...),
+		begin:       begin,
+		rate1:       internal.NewEWMA(time.Minute),
+		rate5:       internal.NewEWMA(time.Minute * 5),
+		rate15:      internal.NewEWMA(time.Minute * 15),
+	}
+	metric.SetMetric(metric).SetCreator(func(l ...string) Metric {
+		return NewMeter(name, help, append(labels, l...)...)
+	})
+
+	return metric
+}
+
+func (m *meterMetric) Description() *Description {
+	return m.description
+}
+
+func (m *meterMetric) Measure() (*MeasureValue, error) {
+	count := m.Count()
+
+	return &MeasureValue{
+		Value:       Float64(float64(count)),
+		SampleCount: Uint64(uint64(count)),
+		Rate1:       Float64(m.Rate1()),
+		Rate5:       Float64(m.Rate5()),
+		Rate15:      Float64(m.Rate15()),
+		RateMean:    Float64(m.RateMean()),
+	}, nil
+}
+
+func (m *meterMetric) Mark(n int64) {
+	m.tickIfNecessary()
+
+	atomic.AddInt64(&m.count, n)
+
+	m.rate1.Update(n)
+	m.rate5.Update(n)
+	m.rate15.Update(n)
+}
+
+func (m *meterMetric) Count() int64 {
+	return atomic.LoadInt64(&m.count)
+}
+
+func (m *meterMetric) Rate1() float64 {
+	m.tickIfNecessary()
+
+	return m.rate1.Rate()
+}
+
+func (m *meterMetric) Rate5() float64 {
+	m.tickIfNecessary()
+
+	return m.rate5.Rate()
+}
+
+func (m *meterMetric) Rate15() float64 {
+	m.tickIfNecessary()
+
+	return m.rate15.Rate()
+}
+
+func (m *meterMetric) RateMean() float64 {
+	elapsed := time.Since(m.begin).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(m.Count()) / elapsed
+}
+
+func (m *meterMetric) With(labels ...string) Meter {
+	return m.Vector.With(labels...).(Meter)
+}
+
+// tickIfNecessary updates rates for all intervals elapsed since the last tick,
+// meters are ticked lazily on mark and read, so nothing holds them after they are dropped
+func (m *meterMetric) tickIfNecessary() {
+	last := atomic.LoadInt64(&m.lastTick)
+	age := time.Now().UnixNano() - last
+	interval := int64(internal.EWMATickInterval)
+
+	if age < interval {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt64(&m.lastTick, last, last+age-age%interval) {
+		return
+	}
+
+	for i := age / interval; i > 0; i-- {
+		m.rate1.Tick()
+		m.rate5.Tick()
+		m.rate15.Tick()
+	}
+}
@@ -0,0 +1,112 @@
+package snitch
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch/internal"
+)
+
+// rewindMeter moves the last tick of meter back by the duration
+func rewindMeter(m *meterMetric, d time.Duration) int64 {
+	last := time.Now().Add(-d).UnixNano()
+	atomic.StoreInt64(&m.lastTick, last)
+
+	return last
+}
+
+func TestMeterDecay(t *testing.T) {
+	m := NewMeter("requests", "").(*meterMetric)
+	m.Mark(300)
+
+	if rate := m.Rate1(); rate != 0 {
+		t.Fatalf("rate %v before the first tick, expected 0", rate)
+	}
+
+	// the first tick takes instant rate as is
+	rewindMeter(m, internal.EWMATickInterval)
+
+	if rate := m.Rate1(); rate != 60 {
+		t.Fatalf("rate %v after the first tick, expected 60", rate)
+	}
+
+	// a minute without marks, the remainder of interval is kept for the next tick
+	last := rewindMeter(m, time.Minute+2*time.Second)
+
+	tests := []struct {
+		name     string
+		rate     float64
+		expected float64
+	}{
+		{"rate_1", m.Rate1(), 60 * math.Exp(-1)},
+		{"rate_5", m.Rate5(), 60 * math.Exp(-1.0/5)},
+		{"rate_15", m.Rate15(), 60 * math.Exp(-1.0/15)},
+	}
+
+	for _, test := range tests {
+		if math.Abs(test.rate-test.expected) > 1e-9 {
+			t.Fatalf("%s is %v, expected %v", test.name, test.rate, test.expected)
+		}
+	}
+
+	if tick := atomic.LoadInt64(&m.lastTick); tick != last+int64(time.Minute) {
+		t.Fatalf("last tick moved by %s, expected by a minute", time.Duration(tick-last))
+	}
+}
+
+func TestMeterRateMean(t *testing.T) {
+	m := NewMeter("requests", "").(*meterMetric)
+	m.begin = time.Now().Add(-10 * time.Second)
+
+	m.Mark(30)
+	m.Mark(20)
+
+	if rate := m.RateMean(); math.Abs(rate-5) > 0.01 {
+		t.Fatalf("mean rate %v, expected 5", rate)
+	}
+
+	measure, err := m.Measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *measure.SampleCount != 50 || *measure.Value != 50 || math.Abs(*measure.RateMean-5) > 0.01 {
+		t.Fatalf("unexpected measure %+v", measure)
+	}
+}
+
+func TestMeterConcurrentTick(t *testing.T) {
+	m := NewMeter("requests", "").(*meterMetric)
+	last := rewindMeter(m, 3*internal.EWMATickInterval+time.Second)
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			<-start
+			m.Mark(1)
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	if m.Count() != 50 {
+		t.Fatalf("count %d, expected 50", m.Count())
+	}
+
+	// only one of concurrent marks wins and ticks for all elapsed intervals
+	if tick := atomic.LoadInt64(&m.lastTick); tick != last+3*int64(internal.EWMATickInterval) {
+		t.Fatalf("last tick moved by %s, expected by three intervals", time.Duration(tick-last))
+	}
+}
@@ -0,0 +1,45 @@
+package snitch
+
+import (
+	"time"
+)
+
+type RegistryOption func(*Registry)
+
+type Logger interface {
+	Print(...interface{})
+}
+
+// WithCollectorTimeout limits time of Collect and Measure calls of every collector,
+// collectors are run concurrently and those not finished in time are reported
+// by CollectorError while measures of the rest are returned
+func WithCollectorTimeout(d time.Duration) RegistryOption {
+	return func(r *Registry) {
+		r.collectorTimeout = d
+	}
+}
+
+func WithInstrumentation() RegistryOption {
+	return func(r *Registry) {
+		r.instrumentation = newRegistryCollector()
+		r.Register(r.instrumentation)
+	}
+}
+
+func WithErrorHandler(f func(error)) RegistryOption {
+	return func(r *Registry) {
+		if f != nil {
+			r.errorHandler = f
+		}
+	}
+}
+
+func WithLogger(l Logger) RegistryOption {
+	return func(r *Registry) {
+		if l != nil {
+			r.errorHandler = func(err error) {
+				l.Print(err.Error())
+			}
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package snitch
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
+	"reflect"
 	"sync"
 	"time"
 
@@ -12,20 +15,35 @@ import (
 
 const (
 	sizeOfDescribeChannel = 10000
-	sizeOfCollectChannel  = 10000
+	sizeOfCollectChannel  = 100
 
 	notRunningSendInterval = time.Hour
 )
 
 type Registerer interface {
 	Register(...Collector)
+	Unregister(...Collector)
 	Walk(func(*Description))
 	Gather() (Measures, error)
+	GatherContext(context.Context) (Measures, error)
 	GatherAndSend() error
+	GatherAndSendContext(context.Context) error
 	AddStorages(...Storage)
 	GetStorage(string) (Storage, error)
 	SetLabels(Labels)
 	SendInterval(time.Duration)
+	Close(context.Context) error
+}
+
+type registeredCollector struct {
+	collector    Collector
+	descriptions []*Description
+}
+
+type collectedMetrics struct {
+	collector *registeredCollector
+	measures  Measures
+	err       error
 }
 
 type Registry struct {
@@ -34,16 +52,39 @@ type Registry struct {
 	descriptions *sync.Map
 	storages     *sync.Map
 	labels       Labels
+	writes       sync.WaitGroup
+	// storages with write in progress started by the send loop
+	writing *sync.Map
+
+	collectorTimeout time.Duration
+	instrumentation  *registryCollector
+	errorHandler     func(error)
 
 	sendTicker chan time.Duration
+	wakeup     chan struct{}
+	done       chan struct{}
+	stopped    chan struct{}
+	flushed    chan struct{}
+	flushErr   error
+	closeOnce  sync.Once
 }
 
-func NewRegistry(d time.Duration) Registerer {
+func NewRegistry(d time.Duration, opts ...RegistryOption) Registerer {
 	r := &Registry{
 		collectors:   &sync.Map{},
 		descriptions: &sync.Map{},
 		storages:     &sync.Map{},
+		writing:      &sync.Map{},
 		sendTicker:   make(chan time.Duration),
+		wakeup:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		flushed:      make(chan struct{}),
+		errorHandler: defaultErrorHandler,
+	}
+
+	for _, opt := range opts {
+		opt(r)
 	}
 
 	go func() {
@@ -62,111 +103,150 @@ func (r *Registry) Register(cs ...Collector) {
 			close(descriptionsChan)
 		}()
 
+		rc := &registeredCollector{
+			collector: c,
+		}
+
 		for d := range descriptionsChan {
+			rc.descriptions = append(rc.descriptions, d)
+		}
+
+		r.mutex.Lock()
+
+		for _, d := range rc.descriptions {
 			r.descriptions.Store(d.ID(), d)
 		}
 
-		r.collectors.Store(uuid.New(), c)
+		r.collectors.Store(uuid.New(), rc)
+
+		r.mutex.Unlock()
 	}
 }
 
-func (r *Registry) Walk(f func(*Description)) {
-	r.descriptions.Range(func(_, value interface{}) bool {
-		f(value.(*Description))
-		return true
-	})
-}
+func (r *Registry) Unregister(cs ...Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-func (r *Registry) Gather() (Measures, error) {
-	var wg sync.WaitGroup
+	for _, c := range cs {
+		var descriptions []*Description
 
-	metricsChan := make(chan Metric, sizeOfCollectChannel)
-	measures := Measures{}
+		r.collectors.Range(func(key, value interface{}) bool {
+			if rc := value.(*registeredCollector); sameCollector(rc.collector, c) {
+				r.collectors.Delete(key)
+				descriptions = append(descriptions, rc.descriptions...)
+			}
 
-	r.collectors.Range(func(_, _ interface{}) bool {
-		wg.Add(1)
-		return true
-	})
+			return true
+		})
 
-	go func() {
-		wg.Wait()
-		close(metricsChan)
-	}()
+		if len(descriptions) == 0 {
+			continue
+		}
 
-	r.collectors.Range(func(_, value interface{}) bool {
-		go func(c Collector) {
-			defer wg.Done()
-			c.Collect(metricsChan)
-		}(value.(Collector))
+		used := make(map[string]struct{})
+
+		r.collectors.Range(func(_, value interface{}) bool {
+			for _, d := range value.(*registeredCollector).descriptions {
+				used[d.ID()] = struct{}{}
+			}
+
+			return true
+		})
 
+		for _, d := range descriptions {
+			if _, ok := used[d.ID()]; !ok {
+				r.descriptions.Delete(d.ID())
+			}
+		}
+	}
+}
+
+func (r *Registry) Walk(f func(*Description)) {
+	r.descriptions.Range(func(_, value interface{}) bool {
+		f(value.(*Description))
 		return true
 	})
+}
 
-	for metric := range metricsChan {
-		value, err := metric.Measure()
-		if err != nil {
-			return nil, err
-		}
+func (r *Registry) Gather() (Measures, error) {
+	return r.GatherContext(context.Background())
+}
 
-		measures = append(measures, &Measure{
-			Description: metric.Description(),
-			CreatedAt:   time.Now(),
-			Value:       value,
-		})
+func (r *Registry) GatherContext(ctx context.Context) (Measures, error) {
+	begin := time.Now()
+	measures, err := r.gather(ctx)
+
+	if r.instrumentation != nil {
+		r.instrumentation.gathered(begin, measures)
 	}
 
-	return measures, nil
+	return measures, err
 }
 
-func (r *Registry) GatherAndSend() error {
-	measures, err := r.Gather()
-	if err != nil {
-		return err
+func (r *Registry) gather(ctx context.Context) (Measures, error) {
+	// all collectors are started at once, so the common deadline is the timeout of each of them
+	if r.collectorTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, r.collectorTimeout)
+		defer cancel()
 	}
 
-	var sizeOfStorages int
+	pending := make(map[*registeredCollector]struct{})
 
-	r.storages.Range(func(_, _ interface{}) bool {
-		sizeOfStorages++
+	r.collectors.Range(func(_, value interface{}) bool {
+		pending[value.(*registeredCollector)] = struct{}{}
 		return true
 	})
 
-	if sizeOfStorages == 0 {
-		return nil
+	// buffered for all collectors so late results never block
+	results := make(chan *collectedMetrics, len(pending))
+
+	for rc := range pending {
+		go collect(rc, results)
 	}
 
-	var wg sync.WaitGroup
+	var (
+		measures = Measures{}
+		err      error
+	)
 
-	wg.Add(sizeOfStorages)
-	errorChan := make(chan error, sizeOfStorages)
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.collector)
+
+			measures = append(measures, result.measures...)
+			err = multierr.Append(err, result.err)
+
+		case <-ctx.Done():
+			for rc := range pending {
+				err = multierr.Append(err, &CollectorError{
+					Descriptions: rc.descriptions,
+					Err:          ctx.Err(),
+				})
+			}
 
-	go func() {
-		wg.Wait()
-		close(errorChan)
-	}()
+			return measures, err
+		}
+	}
 
-	r.mutex.RLock()
-	l := r.labels
-	r.mutex.RUnlock()
+	return measures, err
+}
 
-	r.storages.Range(func(_, value interface{}) bool {
-		go func(s Storage, m Measures, l Labels) {
-			defer wg.Done()
+func (r *Registry) GatherAndSend() error {
+	return r.GatherAndSendContext(context.Background())
+}
 
-			s.SetLabels(l)
-			if e := s.Write(m); e != nil {
-				errorChan <- e
-			}
-		}(value.(Storage), measures, l)
+func (r *Registry) GatherAndSendContext(ctx context.Context) error {
+	storages := make([]Storage, 0)
 
+	r.storages.Range(func(_, value interface{}) bool {
+		storages = append(storages, value.(Storage))
 		return true
 	})
 
-	for e := range errorChan {
-		err = multierr.Append(err, e)
-	}
-
-	return err
+	return r.gatherAndSendTo(ctx, storages)
 }
 
 func (r *Registry) AddStorages(ss ...Storage) {
@@ -177,6 +257,11 @@ func (r *Registry) AddStorages(ss ...Storage) {
 
 		r.storages.Store(s.ID(), s)
 	}
+
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
 }
 
 func (r *Registry) GetStorage(id string) (Storage, error) {
@@ -199,37 +284,351 @@ func (r *Registry) SetLabels(l Labels) {
 }
 
 func (r *Registry) SendInterval(d time.Duration) {
-	r.sendTicker <- d
+	select {
+	case r.sendTicker <- d:
+	case <-r.done:
+	}
 }
 
-func (r *Registry) send(d time.Duration) {
-	running := true
-	if d <= 0 {
-		running = false
-		d = notRunningSendInterval
+// Close stops the send loop, sends the last gathered measures to the storages
+// and waits for all in-flight writes until the context is done. The final flush
+// is done once, the next calls wait for its result
+func (r *Registry) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+
+		go r.flush(ctx)
+	})
+
+	select {
+	case <-r.flushed:
+		return r.flushErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Registry) flush(ctx context.Context) {
+	defer close(r.flushed)
+
+	select {
+	case <-r.stopped:
+	case <-ctx.Done():
+		r.flushErr = ctx.Err()
+		return
+	}
+
+	err := r.GatherAndSendContext(ctx)
+	written := make(chan struct{})
+
+	go func() {
+		r.writes.Wait()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
 	}
 
-	ticker := time.NewTicker(d)
+	r.flushErr = err
+}
+
+func (r *Registry) send(d time.Duration) {
+	defer close(r.stopped)
+
+	// gather in progress is canceled when the registry is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-r.done
+		cancel()
+	}()
+
+	schedule := make(map[string]time.Time)
 
 	for {
+		now := time.Now()
+		due := make([]Storage, 0)
+		next := now.Add(notRunningSendInterval)
+
+		r.storages.Range(func(key, value interface{}) bool {
+			id := key.(string)
+			interval, jitter := d, time.Duration(0)
+
+			if ss, ok := value.(StorageScheduled); ok && ss.SendInterval() > 0 {
+				interval, jitter = ss.SendInterval(), ss.SendJitter()
+			}
+
+			if interval <= 0 {
+				delete(schedule, id)
+				return true
+			}
+
+			at, ok := schedule[id]
+			if !ok {
+				at = now.Add(interval + randomJitter(jitter))
+			} else if !now.Before(at) {
+				due = append(due, value.(Storage))
+				at = now.Add(interval + randomJitter(jitter))
+			}
+
+			schedule[id] = at
+
+			if at.Before(next) {
+				next = at
+			}
+
+			return true
+		})
+
+		if len(due) > 0 {
+			// slow gathers must not starve stopping and changing of the interval
+			select {
+			case <-r.done:
+				return
+
+			case d = <-r.sendTicker:
+				r.reschedule(schedule)
+				continue
+
+			default:
+			}
+
+			r.gatherAndSendAsync(ctx, due)
+
+			continue
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+
 		select {
-		case <-ticker.C:
-			if running {
-				err := r.GatherAndSend()
+		case <-r.done:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+
+		case <-r.wakeup:
+			timer.Stop()
+
+		case d = <-r.sendTicker:
+			timer.Stop()
+			r.reschedule(schedule)
+		}
+	}
+}
+
+// reschedule resets schedule of storages with the default interval, so they are sent from now
+func (r *Registry) reschedule(schedule map[string]time.Time) {
+	r.storages.Range(func(key, value interface{}) bool {
+		if ss, ok := value.(StorageScheduled); !ok || ss.SendInterval() <= 0 {
+			delete(schedule, key.(string))
+		}
+
+		return true
+	})
+}
+
+func (r *Registry) gatherAndSendTo(ctx context.Context, storages []Storage) error {
+	measures, err := r.GatherContext(ctx)
+	if measures == nil || len(storages) == 0 {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(len(storages))
+	r.writes.Add(len(storages))
+	errorChan := make(chan error, len(storages))
+
+	go func() {
+		wg.Wait()
+		close(errorChan)
+	}()
+
+	l := r.getLabels()
 
-				if err != nil {
-					log.Print(err.Error())
-				}
+	for _, s := range storages {
+		go func(s Storage) {
+			defer func() {
+				wg.Done()
+				r.writes.Done()
+			}()
+
+			if e := r.write(s, measures, l); e != nil {
+				errorChan <- e
 			}
-		case d := <-r.sendTicker:
-			if d <= 0 {
-				running = false
-				d = notRunningSendInterval
-			} else {
-				running = true
+		}(s)
+	}
+
+	for {
+		select {
+		case e, ok := <-errorChan:
+			if !ok {
+				return err
 			}
 
-			ticker = time.NewTicker(d)
+			err = multierr.Append(err, e)
+
+		case <-ctx.Done():
+			return multierr.Append(err, ctx.Err())
 		}
 	}
 }
+
+// gatherAndSendAsync waits for the gather only, writes are run in background,
+// so a slow storage skips only its own ticks while its previous write is in progress
+func (r *Registry) gatherAndSendAsync(ctx context.Context, due []Storage) {
+	storages := make([]Storage, 0, len(due))
+
+	for _, s := range due {
+		if _, busy := r.writing.LoadOrStore(s.ID(), struct{}{}); !busy {
+			storages = append(storages, s)
+		}
+	}
+
+	if len(storages) == 0 {
+		return
+	}
+
+	measures, err := r.GatherContext(ctx)
+
+	select {
+	case <-r.done:
+		// gather is canceled by closing and the final flush is done by Close
+		measures, err = nil, nil
+	default:
+	}
+
+	for _, e := range multierr.Errors(err) {
+		r.errorHandler(e)
+	}
+
+	if measures == nil {
+		for _, s := range storages {
+			r.writing.Delete(s.ID())
+		}
+
+		return
+	}
+
+	l := r.getLabels()
+	r.writes.Add(len(storages))
+
+	for _, s := range storages {
+		go func(s Storage) {
+			defer func() {
+				r.writing.Delete(s.ID())
+				r.writes.Done()
+			}()
+
+			if e := r.write(s, measures, l); e != nil {
+				r.errorHandler(e)
+			}
+		}(s)
+	}
+}
+
+func (r *Registry) write(s Storage, measures Measures, l Labels) error {
+	s.SetLabels(l)
+
+	begin := time.Now()
+	err := s.Write(measures)
+
+	if r.instrumentation != nil {
+		r.instrumentation.written(s.ID(), begin, err)
+	}
+
+	if err != nil {
+		return &StorageError{
+			ID:  s.ID(),
+			Err: err,
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) getLabels() Labels {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.labels
+}
+
+// sameCollector compares collectors without panic on values which are not comparable,
+// maps and functions are compared by pointer and the rest of not comparable values
+// are never the same, such collectors must be registered by pointer to be unregistered
+func sameCollector(a, b Collector) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		return false
+	}
+
+	switch va.Kind() {
+	case reflect.Map, reflect.Func:
+		return va.Pointer() == vb.Pointer()
+	}
+
+	return va.Comparable() && va.Equal(vb)
+}
+
+func defaultErrorHandler(err error) {
+	log.Print(err.Error())
+}
+
+func randomJitter(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+func collect(rc *registeredCollector, results chan<- *collectedMetrics) {
+	metricsChan := make(chan Metric, sizeOfCollectChannel)
+	done := make(chan []Metric, 1)
+
+	go func() {
+		metrics := make([]Metric, 0, len(rc.descriptions))
+
+		for metric := range metricsChan {
+			metrics = append(metrics, metric)
+		}
+
+		done <- metrics
+	}()
+
+	rc.collector.Collect(metricsChan)
+	close(metricsChan)
+
+	result := &collectedMetrics{
+		collector: rc,
+	}
+
+	// measuring is a part of collecting, so slow metrics are covered by the collector timeout
+	for _, metric := range <-done {
+		value, err := metric.Measure()
+		if err != nil {
+			result.err = multierr.Append(result.err, &MeasureError{
+				Description: metric.Description(),
+				Err:         err,
+			})
+
+			continue
+		}
+
+		result.measures = append(result.measures, &Measure{
+			Description: metric.Description(),
+			CreatedAt:   time.Now(),
+			Value:       value,
+		})
+	}
+
+	results <- result
+}
@@ -0,0 +1,55 @@
+package snitch
+
+import (
+	"time"
+)
+
+const (
+	MetricGatherDuration       = "snitch_gather_duration_seconds"
+	MetricSeries               = "snitch_series"
+	MetricStorageWriteDuration = "snitch_storage_write_duration_seconds"
+	MetricStorageWriteErrors   = "snitch_storage_write_errors_total"
+)
+
+type registryCollector struct {
+	gatherDuration       Timer
+	series               Gauge
+	storageWriteDuration Timer
+	storageWriteErrors   Counter
+}
+
+func newRegistryCollector() *registryCollector {
+	return &registryCollector{
+		gatherDuration:       NewTimer(MetricGatherDuration, "Duration of gathering measures from all collectors"),
+		series:               NewGauge(MetricSeries, "Number of series in the last gather"),
+		storageWriteDuration: NewTimer(MetricStorageWriteDuration, "Duration of writing measures to storage"),
+		storageWriteErrors:   NewCounter(MetricStorageWriteErrors, "Number of failed writes to storage"),
+	}
+}
+
+func (c *registryCollector) Describe(ch chan<- *Description) {
+	c.gatherDuration.Describe(ch)
+	c.series.Describe(ch)
+	c.storageWriteDuration.Describe(ch)
+	c.storageWriteErrors.Describe(ch)
+}
+
+func (c *registryCollector) Collect(ch chan<- Metric) {
+	c.gatherDuration.Collect(ch)
+	c.series.Collect(ch)
+	c.storageWriteDuration.Collect(ch)
+	c.storageWriteErrors.Collect(ch)
+}
+
+func (c *registryCollector) gathered(begin time.Time, measures Measures) {
+	c.gatherDuration.UpdateSince(begin)
+	c.series.Set(float64(len(measures)))
+}
+
+func (c *registryCollector) written(id string, begin time.Time, err error) {
+	c.storageWriteDuration.With("storage", id).UpdateSince(begin)
+
+	if err != nil {
+		c.storageWriteErrors.With("storage", id).Inc()
+	}
+}
@@ -0,0 +1,571 @@
+package snitch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+type testStorage struct {
+	mutex sync.Mutex
+
+	id       string
+	delay    time.Duration
+	err      error
+	writes   int
+	measures Measures
+	labels   Labels
+}
+
+func (s *testStorage) ID() string {
+	return s.id
+}
+
+func (s *testStorage) Write(measures Measures) error {
+	time.Sleep(s.delay)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.writes++
+	s.measures = measures
+
+	return s.err
+}
+
+func (s *testStorage) SetLabels(l Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *testStorage) Writes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.writes
+}
+
+func (s *testStorage) Measures() Measures {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.measures
+}
+
+// testCollector collects the metrics after the delay
+type testCollector struct {
+	delay   time.Duration
+	metrics []Metric
+}
+
+func (c *testCollector) Describe(ch chan<- *Description) {
+	for _, m := range c.metrics {
+		ch <- m.Description()
+	}
+}
+
+func (c *testCollector) Collect(ch chan<- Metric) {
+	time.Sleep(c.delay)
+
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+// failedMetric fails on every measure
+type failedMetric struct {
+	description *Description
+}
+
+func (m *failedMetric) Description() *Description {
+	return m.description
+}
+
+func (m *failedMetric) Measure() (*MeasureValue, error) {
+	return nil, errors.New("broken sensor")
+}
+
+// slowMetric measures the metric after the delay
+type slowMetric struct {
+	Metric
+
+	delay time.Duration
+}
+
+func (m *slowMetric) Measure() (*MeasureValue, error) {
+	time.Sleep(m.delay)
+
+	return m.Metric.Measure()
+}
+
+func measureNames(measures Measures) map[string]int {
+	names := make(map[string]int)
+
+	for _, m := range measures {
+		names[m.Description.Name()]++
+	}
+
+	return names
+}
+
+func closeRegistry(t *testing.T, r Registerer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryScheduledStorages(t *testing.T) {
+	r := NewRegistry(50*time.Millisecond, WithErrorHandler(func(error) {}))
+	r.Register(&testCollector{metrics: []Metric{NewCounter("requests_total", "")}})
+
+	fast := &testStorage{id: "fast"}
+	slow := &testStorage{id: "slow", delay: time.Second}
+
+	r.AddStorages(fast, NewScheduledStorage(slow, 100*time.Millisecond, 0))
+
+	time.Sleep(200 * time.Millisecond)
+
+	// the loop is not blocked by the slow write
+	begin := time.Now()
+	r.SendInterval(50 * time.Millisecond)
+
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Fatalf("SendInterval is blocked for %s", elapsed)
+	}
+
+	time.Sleep(800 * time.Millisecond)
+
+	if n := fast.Writes(); n < 10 {
+		t.Fatalf("fast storage got %d writes, it is blocked by the slow one", n)
+	}
+
+	// write in progress skips ticks of the slow storage only
+	if n := slow.Writes(); n > 1 {
+		t.Fatalf("slow storage got %d writes while the first one is in progress", n)
+	}
+
+	closeRegistry(t, r)
+}
+
+func TestRegistrySendIntervalStop(t *testing.T) {
+	r := NewRegistry(20*time.Millisecond, WithErrorHandler(func(error) {}))
+	r.Register(&testCollector{metrics: []Metric{NewGauge("temperature", "")}})
+
+	s := &testStorage{id: "storage"}
+	r.AddStorages(s)
+
+	time.Sleep(100 * time.Millisecond)
+	r.SendInterval(0)
+
+	// let write started before stop finish
+	time.Sleep(20 * time.Millisecond)
+	n := s.Writes()
+
+	if n == 0 {
+		t.Fatal("nothing is written before stop")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if s.Writes() != n {
+		t.Fatalf("%d writes after the interval is set to zero", s.Writes()-n)
+	}
+
+	closeRegistry(t, r)
+}
+
+// sliceCollector isn't comparable by value
+type sliceCollector struct {
+	inner interface{}
+}
+
+func (c sliceCollector) Describe(chan<- *Description) {}
+
+func (c sliceCollector) Collect(chan<- Metric) {}
+
+// mapCollector is compared by pointer
+type mapCollector map[string]Metric
+
+func (c mapCollector) Describe(ch chan<- *Description) {
+	for _, m := range c {
+		ch <- m.Description()
+	}
+}
+
+func (c mapCollector) Collect(ch chan<- Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+func registeredNames(r Registerer) map[string]int {
+	names := make(map[string]int)
+
+	r.Walk(func(d *Description) {
+		names[d.Name()]++
+	})
+
+	return names
+}
+
+func TestRegistryUnregister(t *testing.T) {
+	r := NewRegistry(0)
+	defer closeRegistry(t, r)
+
+	shared := NewGauge("shared", "")
+
+	first := &testCollector{metrics: []Metric{NewCounter("first_total", ""), shared}}
+	second := &testCollector{metrics: []Metric{NewCounter("second_total", ""), shared}}
+	// the same content as the first collector, but registered separately
+	copied := &testCollector{metrics: first.metrics}
+
+	r.Register(first, second, copied)
+	r.Unregister(first)
+
+	if names := registeredNames(r); names["first_total"] != 1 || names["second_total"] != 1 || names["shared"] != 1 {
+		t.Fatalf("unexpected descriptions %v", names)
+	}
+
+	r.Unregister(copied)
+
+	if names := registeredNames(r); names["first_total"] != 0 || names["shared"] != 1 {
+		t.Fatalf("unexpected descriptions %v after unregister of all collectors of metric", names)
+	}
+
+	measures, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := measureNames(measures); len(names) != 2 || names["second_total"] != 1 || names["shared"] != 1 {
+		t.Fatalf("unexpected measures %v", names)
+	}
+
+	r.Unregister(second)
+
+	if names := registeredNames(r); len(names) != 0 {
+		t.Fatalf("descriptions %v are left", names)
+	}
+}
+
+func TestRegistryUnregisterNotComparable(t *testing.T) {
+	r := NewRegistry(0)
+	defer closeRegistry(t, r)
+
+	r.Register(sliceCollector{inner: []int{1}})
+	r.Unregister(sliceCollector{inner: []int{1}})
+
+	c := mapCollector{"gauge": NewGauge("gauge", "")}
+	r.Register(c)
+	r.Unregister(mapCollector{"gauge": c["gauge"]})
+
+	if names := registeredNames(r); names["gauge"] != 1 {
+		t.Fatal("other map with the same content is unregistered")
+	}
+
+	r.Unregister(c)
+
+	if names := registeredNames(r); names["gauge"] != 0 {
+		t.Fatal("map collector isn't unregistered")
+	}
+}
+
+func TestRegistryCloseFlush(t *testing.T) {
+	r := NewRegistry(time.Hour)
+	r.Register(&testCollector{metrics: []Metric{NewCounter("requests_total", "")}})
+
+	s := &testStorage{id: "storage"}
+	r.AddStorages(s)
+
+	closeRegistry(t, r)
+
+	if n := s.Writes(); n != 1 {
+		t.Fatalf("%d writes on close, expected the final flush", n)
+	}
+
+	if names := measureNames(s.Measures()); names["requests_total"] != 1 {
+		t.Fatalf("unexpected measures of the final flush %v", names)
+	}
+
+	// the next calls wait for the result of the first one
+	closeRegistry(t, r)
+
+	if n := s.Writes(); n != 1 {
+		t.Fatalf("%d writes after the second close", n)
+	}
+}
+
+func TestRegistryCloseDeadline(t *testing.T) {
+	r := NewRegistry(time.Hour)
+	r.Register(&testCollector{metrics: []Metric{NewCounter("requests_total", "")}})
+	r.AddStorages(&testStorage{id: "storage", delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+
+	if err := r.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("close returned after %s", elapsed)
+	}
+}
+
+func TestRegistryCloseCancelsGather(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		errs   []error
+		handle = func(err error) {
+			mutex.Lock()
+			errs = append(errs, err)
+			mutex.Unlock()
+		}
+	)
+
+	r := NewRegistry(10*time.Millisecond, WithErrorHandler(handle))
+	r.Register(&testCollector{delay: 200 * time.Millisecond, metrics: []Metric{NewGauge("temperature", "")}})
+	r.AddStorages(&testStorage{id: "storage"})
+
+	// the gather of the send loop is in progress
+	time.Sleep(50 * time.Millisecond)
+	closeRegistry(t, r)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(errs) > 0 {
+		t.Fatalf("errors %v are reported on close", errs)
+	}
+}
+
+func TestRegistryCollectorTimeout(t *testing.T) {
+	r := NewRegistry(0, WithCollectorTimeout(50*time.Millisecond))
+	// the final gather fails by timeout as well
+	defer r.Close(context.Background())
+
+	slow := NewGauge("slow", "")
+	slowMeasure := &slowMetric{Metric: NewGauge("slow_measure", ""), delay: time.Second}
+
+	r.Register(
+		&testCollector{metrics: []Metric{NewGauge("fast", "")}},
+		&testCollector{delay: time.Second, metrics: []Metric{slow}},
+		&testCollector{metrics: []Metric{slowMeasure}},
+	)
+
+	begin := time.Now()
+	measures, err := r.Gather()
+
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("gather returned after %s", elapsed)
+	}
+
+	if names := measureNames(measures); len(names) != 1 || names["fast"] != 1 {
+		t.Fatalf("unexpected measures %v", names)
+	}
+
+	failed := make(map[string]bool)
+
+	for _, e := range multierr.Errors(err) {
+		var collectorErr *CollectorError
+
+		if !errors.As(e, &collectorErr) || !errors.Is(e, context.DeadlineExceeded) {
+			t.Fatalf("expected collector error, got %v", e)
+		}
+
+		for _, d := range collectorErr.Descriptions {
+			failed[d.Name()] = true
+		}
+	}
+
+	if len(failed) != 2 || !failed["slow"] || !failed["slow_measure"] {
+		t.Fatalf("unexpected failed collectors %v", failed)
+	}
+}
+
+func TestRegistryGatherContext(t *testing.T) {
+	r := NewRegistry(0)
+	defer closeRegistry(t, r)
+
+	r.Register(&testCollector{delay: 200 * time.Millisecond, metrics: []Metric{NewGauge("slow", "")}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.GatherContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
+
+func TestRegistryMeasureErrors(t *testing.T) {
+	r := NewRegistry(0)
+	defer r.Close(context.Background())
+
+	broken := []Metric{
+		&failedMetric{description: NewDescription("voltage", "", MetricTypeGauge, "phase", "a")},
+		&failedMetric{description: NewDescription("voltage", "", MetricTypeGauge, "phase", "b")},
+	}
+
+	r.Register(&testCollector{metrics: append([]Metric{NewGauge("temperature", "")}, broken...)})
+
+	s := &testStorage{id: "storage"}
+	r.AddStorages(s)
+
+	err := r.GatherAndSend()
+
+	errs := multierr.Errors(err)
+	if len(errs) != len(broken) {
+		t.Fatalf("%d errors, expected %d: %v", len(errs), len(broken), err)
+	}
+
+	for i, e := range errs {
+		var measureErr *MeasureError
+
+		if !errors.As(e, &measureErr) {
+			t.Fatalf("expected measure error, got %v", e)
+		}
+
+		if measureErr.Description != broken[0].Description() && measureErr.Description != broken[1].Description() {
+			t.Fatalf("unexpected description of error %d: %v", i, measureErr.Description)
+		}
+	}
+
+	// good measures are sent anyway
+	if names := measureNames(s.Measures()); len(names) != 1 || names["temperature"] != 1 {
+		t.Fatalf("unexpected measures %v", names)
+	}
+}
+
+func TestRegistryInstrumentation(t *testing.T) {
+	r := NewRegistry(0, WithInstrumentation())
+	defer r.Close(context.Background())
+
+	r.Register(&testCollector{metrics: []Metric{NewGauge("temperature", ""), NewGauge("humidity", "")}})
+	r.AddStorages(&testStorage{id: "good"}, &testStorage{id: "bad", err: errors.New("unavailable")})
+
+	if err := r.GatherAndSend(); err == nil {
+		t.Fatal("expected error of the bad storage")
+	}
+
+	measures, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]*MeasureValue)
+
+	for _, m := range measures {
+		key := m.Description.Name()
+		if storage := m.Description.Labels().Map()["storage"]; storage != "" {
+			key += "/" + storage
+		}
+
+		values[key] = m.Value
+	}
+
+	// series of the previous gather are the metrics of the collector and of the registry
+	if v := values[MetricSeries]; v == nil || *v.Value < 2 {
+		t.Fatalf("unexpected %s %v", MetricSeries, v)
+	}
+
+	if v := values[MetricGatherDuration]; v == nil || *v.SampleCount != 1 {
+		t.Fatalf("unexpected %s %v", MetricGatherDuration, v)
+	}
+
+	for _, id := range []string{"good", "bad"} {
+		if v := values[MetricStorageWriteDuration+"/"+id]; v == nil || *v.SampleCount != 1 {
+			t.Fatalf("unexpected %s of %s storage %v", MetricStorageWriteDuration, id, v)
+		}
+	}
+
+	if v := values[MetricStorageWriteErrors+"/bad"]; v == nil || *v.Value != 1 {
+		t.Fatalf("unexpected %s of bad storage %v", MetricStorageWriteErrors, v)
+	}
+
+	if v := values[MetricStorageWriteErrors+"/good"]; v != nil && *v.Value != 0 {
+		t.Fatalf("unexpected %s of good storage %v", MetricStorageWriteErrors, v)
+	}
+}
+
+type testLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Print(v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, line := range v {
+		l.lines = append(l.lines, line.(string))
+	}
+}
+
+func (l *testLogger) Lines() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+func TestRegistryErrorHandler(t *testing.T) {
+	errs := make(chan error, 10)
+
+	r := NewRegistry(20*time.Millisecond, WithErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	defer r.Close(context.Background())
+
+	r.Register(&testCollector{metrics: []Metric{NewGauge("temperature", "")}})
+	r.AddStorages(&testStorage{id: "influx", err: errors.New("unavailable")})
+
+	select {
+	case err := <-errs:
+		var storageErr *StorageError
+
+		if !errors.As(err, &storageErr) || storageErr.ID != "influx" || storageErr.Err.Error() != "unavailable" {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("error isn't handled")
+	}
+}
+
+func TestRegistryLogger(t *testing.T) {
+	logger := &testLogger{}
+
+	r := NewRegistry(20*time.Millisecond, WithLogger(logger))
+	r.Register(&testCollector{metrics: []Metric{&failedMetric{description: NewDescription("voltage", "", MetricTypeGauge)}}})
+	r.AddStorages(&testStorage{id: "influx"})
+
+	time.Sleep(100 * time.Millisecond)
+	r.Close(context.Background())
+
+	lines := logger.Lines()
+	if len(lines) == 0 {
+		t.Fatal("nothing is logged")
+	}
+
+	expected := "failed measure voltage metric with labels map[] because broken sensor"
+
+	for _, line := range lines {
+		if line != expected {
+			t.Fatalf("unexpected line %q, expected %q", line, expected)
+		}
+	}
+}
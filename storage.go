@@ -1,5 +1,9 @@
 package snitch
 
+import (
+	"time"
+)
+
 type Storage interface {
 	ID() string
 	Write(Measures) error
@@ -9,3 +13,43 @@ type Storage interface {
 type StorageRealtime interface {
 	SetCallback(func() (Measures, error))
 }
+
+type StorageScheduled interface {
+	SendInterval() time.Duration
+	SendJitter() time.Duration
+}
+
+type scheduledStorage struct {
+	Storage
+
+	interval time.Duration
+	jitter   time.Duration
+}
+
+// NewScheduledStorage wraps the storage so the registry sends measures to it
+// with its own interval instead of the registry's one
+func NewScheduledStorage(s Storage, interval, jitter time.Duration) Storage {
+	return &scheduledStorage{
+		Storage:  s,
+		interval: interval,
+		jitter:   jitter,
+	}
+}
+
+func (s *scheduledStorage) SendInterval() time.Duration {
+	return s.interval
+}
+
+func (s *scheduledStorage) SendJitter() time.Duration {
+	return s.jitter
+}
+
+func (s *scheduledStorage) SetCallback(f func() (Measures, error)) {
+	if rs, ok := s.Storage.(StorageRealtime); ok {
+		rs.SetCallback(f)
+	}
+}
+
+func (s *scheduledStorage) Unwrap() Storage {
+	return s.Storage
+}
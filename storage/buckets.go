@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+func sortedBuckets(buckets map[float64]*uint64) []float64 {
+	ret := make([]float64, 0, len(buckets))
+
+	for le := range buckets {
+		ret = append(ret, le)
+	}
+
+	sort.Float64s(ret)
+
+	return ret
+}
+
+func formatBucketBound(le float64) string {
+	if math.IsInf(le, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(le, 'g', -1, 64)
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+const (
+	CircuitBreakerClosed CircuitBreakerState = iota
+	CircuitBreakerOpen
+	CircuitBreakerHalfOpen
+
+	MetricCircuitBreakerState = "snitch_storage_circuit_breaker_state"
+
+	DefaultCircuitBreakerWriteTimeout     = 10 * time.Second
+	DefaultCircuitBreakerOpenTimeout      = 30 * time.Second
+	DefaultCircuitBreakerFailureThreshold = 5
+	DefaultCircuitBreakerSuccessThreshold = 1
+)
+
+var (
+	ErrCircuitBreakerOpen = errors.New("circuit breaker is open")
+	ErrWriteTimeout       = errors.New("write timeout exceeded")
+
+	CircuitBreakerStateValue = [...]string{
+		"closed",
+		"open",
+		"half-open",
+	}
+)
+
+type CircuitBreakerState int
+
+type CircuitBreakerOption func(*CircuitBreaker)
+
+type CircuitBreaker struct {
+	mutex sync.Mutex
+
+	storage          snitch.Storage
+	writeTimeout     time.Duration
+	openTimeout      time.Duration
+	failureThreshold int
+	successThreshold int
+
+	state     CircuitBreakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+
+	stateGauge snitch.Gauge
+}
+
+func WithCircuitBreakerWriteTimeout(d time.Duration) CircuitBreakerOption {
+	return func(s *CircuitBreaker) {
+		s.writeTimeout = d
+	}
+}
+
+func WithCircuitBreakerOpenTimeout(d time.Duration) CircuitBreakerOption {
+	return func(s *CircuitBreaker) {
+		if d > 0 {
+			s.openTimeout = d
+		}
+	}
+}
+
+func WithCircuitBreakerThresholds(failures, successes int) CircuitBreakerOption {
+	return func(s *CircuitBreaker) {
+		if failures > 0 {
+			s.failureThreshold = failures
+		}
+
+		if successes > 0 {
+			s.successThreshold = successes
+		}
+	}
+}
+
+func NewCircuitBreaker(s snitch.Storage, opts ...CircuitBreakerOption) *CircuitBreaker {
+	storage := &CircuitBreaker{
+		storage:          s,
+		writeTimeout:     DefaultCircuitBreakerWriteTimeout,
+		openTimeout:      DefaultCircuitBreakerOpenTimeout,
+		failureThreshold: DefaultCircuitBreakerFailureThreshold,
+		successThreshold: DefaultCircuitBreakerSuccessThreshold,
+		stateGauge:       snitch.NewGauge(MetricCircuitBreakerState, "State of storage circuit breaker, 0 is closed, 1 is open, 2 is half-open", "storage", s.ID()),
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	return storage
+}
+
+func (s *CircuitBreaker) ID() string {
+	return s.storage.ID()
+}
+
+func (s *CircuitBreaker) Write(measures snitch.Measures) error {
+	ok, probe := s.allow()
+	if !ok {
+		return ErrCircuitBreakerOpen
+	}
+
+	err := s.write(measures)
+	s.done(err, probe)
+
+	return err
+}
+
+func (s *CircuitBreaker) SetLabels(l snitch.Labels) {
+	s.storage.SetLabels(l)
+}
+
+func (s *CircuitBreaker) SetCallback(f func() (snitch.Measures, error)) {
+	if rs, ok := s.storage.(snitch.StorageRealtime); ok {
+		rs.SetCallback(f)
+	}
+}
+
+func (s *CircuitBreaker) SendInterval() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendInterval()
+	}
+
+	return 0
+}
+
+func (s *CircuitBreaker) SendJitter() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendJitter()
+	}
+
+	return 0
+}
+
+func (s *CircuitBreaker) State() CircuitBreakerState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state
+}
+
+func (s *CircuitBreaker) Describe(ch chan<- *snitch.Description) {
+	s.stateGauge.Describe(ch)
+}
+
+func (s *CircuitBreaker) Collect(ch chan<- snitch.Metric) {
+	s.stateGauge.Collect(ch)
+}
+
+func (s *CircuitBreaker) write(measures snitch.Measures) error {
+	if s.writeTimeout <= 0 {
+		return s.storage.Write(measures)
+	}
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- s.storage.Write(measures)
+	}()
+
+	timer := time.NewTimer(s.writeTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return ErrWriteTimeout
+	}
+}
+
+// allow returns whether the write is admitted and whether it is the probe of half-open state
+func (s *CircuitBreaker) allow() (bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case CircuitBreakerOpen:
+		if time.Since(s.openedAt) < s.openTimeout {
+			return false, false
+		}
+
+		s.setState(CircuitBreakerHalfOpen)
+
+		fallthrough
+
+	case CircuitBreakerHalfOpen:
+		// only one probe write at the same time
+		if s.probing {
+			return false, false
+		}
+
+		s.probing = true
+
+		return true, true
+	}
+
+	return true, false
+}
+
+// done records result of the write, only the probe decides state of half-open circuit,
+// late writes admitted while the circuit was closed are ignored in other states
+func (s *CircuitBreaker) done(err error, probe bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if probe != (s.state == CircuitBreakerHalfOpen) {
+		return
+	}
+
+	switch s.state {
+	case CircuitBreakerClosed:
+		if err == nil {
+			s.failures = 0
+			return
+		}
+
+		s.failures++
+
+		if s.failures >= s.failureThreshold {
+			s.setState(CircuitBreakerOpen)
+		}
+
+	case CircuitBreakerHalfOpen:
+		s.probing = false
+
+		if err != nil {
+			s.setState(CircuitBreakerOpen)
+			return
+		}
+
+		s.successes++
+
+		if s.successes >= s.successThreshold {
+			s.setState(CircuitBreakerClosed)
+		}
+	}
+}
+
+// setState must be called under the lock
+func (s *CircuitBreaker) setState(state CircuitBreakerState) {
+	s.state = state
+	s.failures = 0
+	s.successes = 0
+
+	if state == CircuitBreakerOpen {
+		s.openedAt = time.Now()
+	}
+
+	s.stateGauge.Set(float64(state))
+}
+
+func (s CircuitBreakerState) String() string {
+	return CircuitBreakerStateValue[s]
+}
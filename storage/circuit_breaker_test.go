@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+// blockingStorage holds writes until the release channel is closed
+type blockingStorage struct {
+	*testStorage
+
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStorage(id string) *blockingStorage {
+	return &blockingStorage{
+		testStorage: &testStorage{id: id},
+		started:     make(chan struct{}, 10),
+		release:     make(chan struct{}),
+	}
+}
+
+func (s *blockingStorage) Write(measures snitch.Measures) error {
+	s.started <- struct{}{}
+	<-s.release
+
+	return s.testStorage.Write(measures)
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+	s := NewCircuitBreaker(inner,
+		WithCircuitBreakerWriteTimeout(0),
+		WithCircuitBreakerOpenTimeout(30*time.Millisecond),
+		WithCircuitBreakerThresholds(2, 2))
+
+	s.Write(testBatch("first"))
+
+	if s.State() != CircuitBreakerClosed {
+		t.Fatalf("state %s after one failure, expected closed", s.State())
+	}
+
+	s.Write(testBatch("second"))
+
+	if s.State() != CircuitBreakerOpen {
+		t.Fatalf("state %s after two failures, expected open", s.State())
+	}
+
+	if err := s.Write(testBatch("third")); err != ErrCircuitBreakerOpen {
+		t.Fatalf("error %v while open, expected %v", err, ErrCircuitBreakerOpen)
+	}
+
+	if inner.Attempts() != 2 {
+		t.Fatalf("%d writes to storage, expected 2", inner.Attempts())
+	}
+
+	// failed probe opens the circuit again
+	time.Sleep(40 * time.Millisecond)
+	s.Write(testBatch("fourth"))
+
+	if s.State() != CircuitBreakerOpen {
+		t.Fatalf("state %s after failed probe, expected open", s.State())
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	inner.SetError(nil)
+
+	if err := s.Write(testBatch("fifth")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State() != CircuitBreakerHalfOpen {
+		t.Fatalf("state %s after one success, expected half-open", s.State())
+	}
+
+	if err := s.Write(testBatch("sixth")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State() != CircuitBreakerClosed {
+		t.Fatalf("state %s after two successes, expected closed", s.State())
+	}
+
+	names := batchNames(inner.Batches())
+	if len(names) != 2 || names[0] != "fifth" || names[1] != "sixth" {
+		t.Fatalf("written batches %v, expected [fifth sixth]", names)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	inner := newBlockingStorage("influx")
+	inner.SetError(errors.New("unavailable"))
+
+	s := NewCircuitBreaker(inner,
+		WithCircuitBreakerWriteTimeout(0),
+		WithCircuitBreakerOpenTimeout(time.Millisecond),
+		WithCircuitBreakerThresholds(1, 1))
+
+	// the first write fails and opens the circuit
+	close(inner.release)
+	s.Write(testBatch("first"))
+	<-inner.started
+
+	if s.State() != CircuitBreakerOpen {
+		t.Fatalf("state %s, expected open", s.State())
+	}
+
+	inner.release = make(chan struct{})
+	inner.SetError(nil)
+	time.Sleep(10 * time.Millisecond)
+
+	probe := make(chan error, 1)
+
+	go func() {
+		probe <- s.Write(testBatch("probe"))
+	}()
+
+	<-inner.started
+
+	for i := 0; i < 3; i++ {
+		if err := s.Write(testBatch("concurrent")); err != ErrCircuitBreakerOpen {
+			t.Fatalf("error %v while probe is in flight, expected %v", err, ErrCircuitBreakerOpen)
+		}
+	}
+
+	close(inner.release)
+
+	if err := <-probe; err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State() != CircuitBreakerClosed {
+		t.Fatalf("state %s after probe, expected closed", s.State())
+	}
+
+	names := batchNames(inner.Batches())
+	if len(names) != 1 || names[0] != "probe" {
+		t.Fatalf("written batches %v, expected [probe]", names)
+	}
+}
+
+func TestCircuitBreakerWriteTimeout(t *testing.T) {
+	inner := newBlockingStorage("influx")
+	defer close(inner.release)
+
+	s := NewCircuitBreaker(inner,
+		WithCircuitBreakerWriteTimeout(20*time.Millisecond),
+		WithCircuitBreakerThresholds(1, 1))
+
+	start := time.Now()
+
+	if err := s.Write(testBatch("first")); err != ErrWriteTimeout {
+		t.Fatalf("error %v, expected %v", err, ErrWriteTimeout)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write returned after %s", elapsed)
+	}
+
+	if s.State() != CircuitBreakerOpen {
+		t.Fatalf("state %s after timeout, expected open", s.State())
+	}
+}
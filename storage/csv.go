@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	CSVLayoutPerMetric CSVLayout = iota
+	CSVLayoutWide
+
+	CSVWideFileName = "metrics.csv"
+
+	csvFileExt       = ".csv"
+	csvLabelPrefix   = "label_"
+	csvExtraLabels   = "labels"
+	csvTimestampName = "timestamp"
+)
+
+var (
+	ErrCSVMissingColumns = errors.New("no columns in csv header")
+	ErrCSVForeignFile    = errors.New("file has no csv header of timestamp column")
+
+	csvValueColumns = []string{"value", "count", "sum", "min", "max", "variance"}
+	csvRateColumns  = []string{"rate_1", "rate_5", "rate_15", "rate_mean"}
+)
+
+type CSVLayout int
+
+// CSV appends measures to CSV files in the directory, one file per name of metric
+// or one wide file for all metrics. Columns are fixed when the file is created:
+// timestamp, name, type, label_<key> for labels of the first written measures,
+// labels with the rest of labels as key=value pairs, values, quantiles of the first
+// written measures and default quantiles, and rates. Rows of existing files are
+// written by their header, values without columns are skipped and reported by
+// ColumnsError, files written by someone else are never appended
+type CSV struct {
+	mutex sync.Mutex
+
+	id     string
+	dir    string
+	layout CSVLayout
+	labels snitch.Labels
+
+	// header by path of file
+	schemas    map[string][]string
+	columnsErr error
+}
+
+func NewCSV(dir string, layout CSVLayout) (*CSV, error) {
+	return NewCSVWithID("", dir, layout)
+}
+
+func NewCSVWithID(id, dir string, layout CSVLayout) (*CSV, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &CSV{
+		id:      id,
+		dir:     dir,
+		layout:  layout,
+		schemas: make(map[string][]string),
+	}, nil
+}
+
+func (s *CSV) ID() string {
+	return s.id
+}
+
+func (s *CSV) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files := make(map[string]snitch.Measures)
+	order := make([]string, 0)
+
+	s.columnsErr = nil
+
+	for _, m := range measures {
+		path := filepath.Join(s.dir, CSVWideFileName)
+		if s.layout == CSVLayoutPerMetric {
+			path = filepath.Join(s.dir, csvFileName(m.Description.Name()))
+		}
+
+		if _, ok := files[path]; !ok {
+			order = append(order, path)
+		}
+
+		files[path] = append(files[path], m)
+	}
+
+	for _, path := range order {
+		if err := s.write(path, files[path]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *CSV) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+// ColumnsError returns error of values skipped by the last write because
+// the header of file has no columns for them, the rows are written anyway
+func (s *CSV) ColumnsError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.columnsErr
+}
+
+func (s *CSV) write(path string, measures snitch.Measures) error {
+	header, ok := s.schemas[path]
+	if !ok {
+		var err error
+
+		if header, ok, err = readCSVHeader(path); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+
+	// new file, columns of labels and quantiles are taken from the first batch
+	if !ok {
+		header = csvHeader(measures, s.labels)
+
+		if err = w.Write(header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	s.schemas[path] = header
+
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		columns[column] = i
+	}
+
+	missing := make([]string, 0)
+
+	for _, m := range measures {
+		record, lost := csvRecord(m, mergeLabels(s.labels, m.Description.Labels()), columns)
+
+		for _, column := range lost {
+			if !containsString(missing, column) {
+				missing = append(missing, column)
+			}
+		}
+
+		if err = w.Write(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	w.Flush()
+
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		s.columnsErr = fmt.Errorf("values of %s columns are not written to %s because %v", strings.Join(missing, ", "), path, ErrCSVMissingColumns)
+	}
+
+	return nil
+}
+
+// readCSVHeader returns header of existing file, false for missing or empty file
+func readCSVHeader(path string) ([]string, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	header, err := csv.NewReader(bufio.NewReader(f)).Read()
+	if err == io.EOF {
+		return nil, false, nil
+	}
+
+	if err != nil || len(header) == 0 || header[0] != csvTimestampName {
+		return nil, false, fmt.Errorf("%s isn't appended because %v", path, ErrCSVForeignFile)
+	}
+
+	return header, true, nil
+}
+
+func csvHeader(measures snitch.Measures, global snitch.Labels) []string {
+	keys := make([]string, 0)
+	quantiles := make(map[float64]*float64)
+
+	for _, q := range snitch.Quantiles {
+		quantiles[q] = nil
+	}
+
+	for _, m := range measures {
+		for _, l := range mergeLabels(global, m.Description.Labels()) {
+			if !containsString(keys, l.Key) {
+				keys = append(keys, l.Key)
+			}
+		}
+
+		for q := range m.Value.Quantiles {
+			quantiles[q] = nil
+		}
+	}
+
+	sort.Strings(keys)
+
+	header := []string{csvTimestampName, "name", "type"}
+
+	for _, key := range keys {
+		header = append(header, csvLabelPrefix+key)
+	}
+
+	header = append(header, csvExtraLabels)
+	header = append(header, csvValueColumns...)
+
+	for _, q := range sortedQuantiles(quantiles) {
+		header = append(header, csvQuantileColumn(q))
+	}
+
+	return append(header, csvRateColumns...)
+}
+
+// csvRecord places values of measure by columns of header, returns columns
+// missing in the header for values which can't be written
+func csvRecord(m *snitch.Measure, labels snitch.Labels, columns map[string]int) ([]string, []string) {
+	record := make([]string, len(columns))
+	missing := make([]string, 0)
+
+	set := func(column, value string) {
+		if value == "" {
+			return
+		}
+
+		if i, ok := columns[column]; ok {
+			record[i] = value
+		} else {
+			missing = append(missing, column)
+		}
+	}
+
+	set(csvTimestampName, m.CreatedAt.Format(time.RFC3339Nano))
+	set("name", m.Description.Name())
+	set("type", m.Description.Type().String())
+
+	extra := make([]string, 0)
+
+	for _, l := range labels {
+		if i, ok := columns[csvLabelPrefix+l.Key]; ok {
+			record[i] = l.Value
+		} else {
+			extra = append(extra, l.Key+"="+l.Value)
+		}
+	}
+
+	set(csvExtraLabels, strings.Join(extra, ";"))
+
+	var count *float64
+	if m.Value.SampleCount != nil {
+		count = snitch.Float64(float64(*(m.Value.SampleCount)))
+	}
+
+	for i, v := range []*float64{
+		m.Value.Value,
+		count,
+		m.Value.SampleSum,
+		m.Value.SampleMin,
+		m.Value.SampleMax,
+		m.Value.SampleVariance,
+	} {
+		set(csvValueColumns[i], formatCSVFloat(v))
+	}
+
+	for _, q := range sortedQuantiles(m.Value.Quantiles) {
+		set(csvQuantileColumn(q), formatCSVFloat(m.Value.Quantiles[q]))
+	}
+
+	for i, v := range []*float64{
+		m.Value.Rate1,
+		m.Value.Rate5,
+		m.Value.Rate15,
+		m.Value.RateMean,
+	} {
+		set(csvRateColumns[i], formatCSVFloat(v))
+	}
+
+	return record, missing
+}
+
+func csvQuantileColumn(q float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "_", -1)
+}
+
+func csvFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+
+		return '_'
+	}, name) + csvFileExt
+}
+
+// formatCSVFloat returns empty cell for missing and NaN values
+func formatCSVFloat(v *float64) string {
+	if v == nil || math.IsNaN(*v) {
+		return ""
+	}
+
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kihamo/snitch"
+)
+
+func TestCSVQuantilesOfMeasures(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewCSV(dir, CSVLayoutPerMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	histogram := snitch.NewHistogramWithQuantiles("latency", "", []float64{0.75})
+	histogram.Add(3)
+
+	if err = s.Write(testMeasures(histogram)); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "latency.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	expected := []string{
+		"timestamp,name,type,labels,value,count,sum,min,max,variance,p50,p75,p90,p99,rate_1,rate_5,rate_15,rate_mean",
+		"1970-01-01T00:01:40Z,latency,histogram,,,1,3,3,3,0,,3,,,,,,",
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("content:\n%s\nexpected:\n%s", content, strings.Join(expected, "\n"))
+	}
+}
+
+func TestCSVExistingHeader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "temperature.csv")
+
+	if err := ioutil.WriteFile(path, []byte("timestamp,value,count,name,label_room,type\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewCSV(dir, CSVLayoutPerMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauge := snitch.NewGauge("temperature", "", "room", "kitchen")
+	gauge.Set(21.5)
+
+	if err = s.Write(testMeasures(gauge)); err != nil {
+		t.Fatal(err)
+	}
+
+	// columns of labels are missing in the header
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}})
+
+	if err = s.Write(testMeasures(gauge)); err != nil {
+		t.Fatalf("write returned error %v after rows are written", err)
+	}
+
+	if err = s.ColumnsError(); err == nil || !strings.Contains(err.Error(), ErrCSVMissingColumns.Error()) {
+		t.Fatalf("expected error of missing columns, got %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "timestamp,value,count,name,label_room,type\n" +
+		"1970-01-01T00:01:40Z,21.5,1,temperature,kitchen,gauge\n" +
+		"1970-01-01T00:01:40Z,21.5,1,temperature,kitchen,gauge\n"
+
+	if string(content) != expected {
+		t.Fatalf("content:\n%s\nexpected:\n%s", content, expected)
+	}
+}
+
+func TestCSVForeignFile(t *testing.T) {
+	dir := t.TempDir()
+	foreign := filepath.Join(dir, "temperature.csv")
+	empty := filepath.Join(dir, "humidity.csv")
+
+	if err := ioutil.WriteFile(foreign, []byte("room,value\nkitchen,21.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewCSV(dir, CSVLayoutPerMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	humidity := snitch.NewGauge("humidity", "")
+	humidity.Set(40)
+
+	if err = s.Write(testMeasures(humidity)); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(content), "timestamp,name,type,") {
+		t.Fatalf("header isn't written to empty file:\n%s", content)
+	}
+
+	temperature := snitch.NewGauge("temperature", "")
+	temperature.Set(21.5)
+
+	for i := 0; i < 2; i++ {
+		if err = s.Write(testMeasures(temperature)); err == nil || !strings.Contains(err.Error(), ErrCSVForeignFile.Error()) {
+			t.Fatalf("expected error of foreign file, got %v", err)
+		}
+	}
+
+	if content, err = ioutil.ReadFile(foreign); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "room,value\nkitchen,21.5\n" {
+		t.Fatalf("foreign file is changed:\n%s", content)
+	}
+}
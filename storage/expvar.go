@@ -34,6 +34,13 @@ func (v *Var) String() string {
 		b.WriteString(",\"value\": " + strconv.FormatFloat(*(val.Value), 'g', -1, 64))
 		b.WriteString(",\"sample_count\": " + strconv.FormatUint(*(val.SampleCount), 10))
 
+	case snitch.MetricTypeMeter:
+		b.WriteString(",\"sample_count\": " + strconv.FormatUint(*(val.SampleCount), 10))
+		b.WriteString(",\"rate_1\": " + strconv.FormatFloat(*(val.Rate1), 'g', -1, 64))
+		b.WriteString(",\"rate_5\": " + strconv.FormatFloat(*(val.Rate5), 'g', -1, 64))
+		b.WriteString(",\"rate_15\": " + strconv.FormatFloat(*(val.Rate15), 'g', -1, 64))
+		b.WriteString(",\"rate_mean\": " + strconv.FormatFloat(*(val.RateMean), 'g', -1, 64))
+
 	case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
 		b.WriteString(",\"sample_count\": " + strconv.FormatUint(*(val.SampleCount), 10))
 
@@ -58,6 +65,20 @@ func (v *Var) String() string {
 				b.WriteString(",\"p" + strconv.FormatInt(int64(q*100), 10) + "\": " + strconv.FormatFloat(*val, 'g', -1, 64))
 			}
 		}
+
+		if len(val.Buckets) > 0 {
+			b.WriteString(",\"buckets\": {")
+
+			for i, le := range sortedBuckets(val.Buckets) {
+				if i != 0 {
+					b.WriteString(",")
+				}
+
+				b.WriteString("\"" + formatBucketBound(le) + "\": " + strconv.FormatUint(*(val.Buckets[le]), 10))
+			}
+
+			b.WriteString("}")
+		}
 	}
 
 	labels := v.labels().WithLabels(v.description.Labels())
@@ -123,7 +144,7 @@ func (s *Expvar) ID() string {
 func (s *Expvar) Write(measures snitch.Measures) error {
 	for _, m := range measures {
 		switch m.Description.Type() {
-		case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge, snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+		case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge, snitch.MetricTypeHistogram, snitch.MetricTypeTimer, snitch.MetricTypeMeter:
 			if exists := s.expvar.Get(m.Description.Name()); exists != nil {
 				exists.(*Var).update(m.Value)
 			} else {
@@ -166,7 +187,7 @@ func (s *Expvar) SetCallback(f func() (snitch.Measures, error)) {
 func (s *Expvar) String() string {
 	s.mutex.RLock()
 	if s.callback != nil {
-		if measures, err := s.callback(); err == nil {
+		if measures, _ := s.callback(); measures != nil {
 			s.Write(measures)
 		}
 	}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kihamo/snitch"
+)
+
+func TestExpvarBuckets(t *testing.T) {
+	histogram := snitch.NewBucketedHistogram("latency_seconds", "Latency", []float64{0.5, 1})
+	histogram.Add(0.5)
+	histogram.Add(0.75)
+	histogram.Add(2)
+
+	s := NewExpvar()
+
+	if err := s.Write(testMeasures(histogram)); err != nil {
+		t.Fatal(err)
+	}
+
+	var vars map[string]struct {
+		SampleCount uint64            `json:"sample_count"`
+		Buckets     map[string]uint64 `json:"buckets"`
+	}
+
+	if err := json.Unmarshal([]byte(s.String()), &vars); err != nil {
+		t.Fatalf("invalid JSON %s: %v", s.String(), err)
+	}
+
+	v := vars["latency_seconds"]
+	if v.SampleCount != 3 || len(v.Buckets) != 3 || v.Buckets["0.5"] != 1 || v.Buckets["1"] != 2 || v.Buckets["+Inf"] != 3 {
+		t.Fatalf("unexpected var %+v", v)
+	}
+}
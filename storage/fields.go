@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kihamo/snitch"
+)
+
+type measureField struct {
+	suffix string
+	value  float64
+}
+
+// measureFields flattens value of measure to list of named fields, NaN values are skipped
+func measureFields(m *snitch.Measure) []measureField {
+	fields := make([]measureField, 0, 8)
+	add := func(suffix string, value *float64) {
+		if value != nil && !math.IsNaN(*value) {
+			fields = append(fields, measureField{suffix: suffix, value: *value})
+		}
+	}
+
+	switch m.Description.Type() {
+	case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge:
+		add("", m.Value.Value)
+
+	case snitch.MetricTypeMeter:
+		add("count", snitch.Float64(float64(*(m.Value.SampleCount))))
+		add("rate1", m.Value.Rate1)
+		add("rate5", m.Value.Rate5)
+		add("rate15", m.Value.Rate15)
+		add("rate_mean", m.Value.RateMean)
+
+	case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+		add("count", snitch.Float64(float64(*(m.Value.SampleCount))))
+		add("sum", m.Value.SampleSum)
+		add("min", m.Value.SampleMin)
+		add("max", m.Value.SampleMax)
+		add("variance", m.Value.SampleVariance)
+
+		for _, q := range sortedQuantiles(m.Value.Quantiles) {
+			add("p"+strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "_", -1), m.Value.Quantiles[q])
+		}
+
+		for _, le := range sortedBuckets(m.Value.Buckets) {
+			add("bucket_"+strings.Replace(formatBucketBound(le), ".", "_", -1), snitch.Float64(float64(*(m.Value.Buckets[le]))))
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	GraphiteProtocolPlaintext GraphiteProtocol = iota
+	GraphiteProtocolPickle
+
+	DefaultGraphiteTemplate = "{name}"
+
+	graphiteTimeout         = 10 * time.Second
+	graphiteMaxPacketSize   = 1432
+	graphiteMaxPickleBatch  = 500
+	graphiteUnknownValue    = "unknown"
+	graphiteTemplateNameKey = "name"
+)
+
+var (
+	ErrGraphitePickleOverUDP = errors.New("pickle protocol is supported only over tcp")
+)
+
+type GraphiteProtocol int
+
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// Graphite sends measures to Carbon, the path of measure is built from the template
+// where {name} is replaced by name of metric and {key} by value of label with the key,
+// labels which are not used in the template are appended as .key.value pairs
+type Graphite struct {
+	mutex sync.RWMutex
+
+	id       string
+	network  string
+	address  string
+	protocol GraphiteProtocol
+	prefix   string
+	template string
+	labels   snitch.Labels
+}
+
+func NewGraphite(network, address string, protocol GraphiteProtocol, prefix, template string) (*Graphite, error) {
+	return NewGraphiteWithID("", network, address, protocol, prefix, template)
+}
+
+func NewGraphiteWithID(id, network, address string, protocol GraphiteProtocol, prefix, template string) (*Graphite, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &Graphite{
+		id: id,
+	}
+
+	err := storage.Reinitialization(network, address, protocol, prefix, template)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *Graphite) ID() string {
+	return s.id
+}
+
+func (s *Graphite) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	network, address, protocol := s.network, s.address, s.protocol
+	prefix, template := s.prefix, s.template
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	points := make([]graphitePoint, 0, len(measures))
+
+	for _, m := range measures {
+		if *(m.Value.SampleCount) == 0 {
+			continue
+		}
+
+		base := graphitePath(prefix, template, m.Description.Name(), mergeLabels(globalLabels, m.Description.Labels()))
+		timestamp := m.CreatedAt.Unix()
+
+		for _, field := range measureFields(m) {
+			path := base
+			if field.suffix != "" {
+				path += "." + sanitizeGraphiteNode(field.suffix)
+			}
+
+			points = append(points, graphitePoint{
+				path:      path,
+				value:     field.value,
+				timestamp: timestamp,
+			})
+		}
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(network, address, graphiteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetWriteDeadline(time.Now().Add(graphiteTimeout)); err != nil {
+		return err
+	}
+
+	if protocol == GraphiteProtocolPickle {
+		for i := 0; i < len(points); i += graphiteMaxPickleBatch {
+			end := i + graphiteMaxPickleBatch
+			if end > len(points) {
+				end = len(points)
+			}
+
+			if _, err = conn.Write(encodeGraphitePickle(points[i:end])); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	packet := graphiteMaxPacketSize
+	if !strings.HasPrefix(network, "udp") {
+		packet = math.MaxInt32
+	}
+
+	for _, p := range points {
+		line := p.path + " " + strconv.FormatFloat(p.value, 'f', -1, 64) + " " + strconv.FormatInt(p.timestamp, 10) + "\n"
+
+		if buf.Len() > 0 && buf.Len()+len(line) > packet {
+			if _, err = conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+		}
+
+		buf.WriteString(line)
+	}
+
+	_, err = conn.Write(buf.Bytes())
+
+	return err
+}
+
+func (s *Graphite) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *Graphite) Reinitialization(network, address string, protocol GraphiteProtocol, prefix, template string) error {
+	if protocol == GraphiteProtocolPickle && strings.HasPrefix(network, "udp") {
+		return ErrGraphitePickleOverUDP
+	}
+
+	if template == "" {
+		template = DefaultGraphiteTemplate
+	}
+
+	s.mutex.Lock()
+	s.network = network
+	s.address = address
+	s.protocol = protocol
+	s.prefix = strings.Trim(prefix, ".")
+	s.template = template
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func graphitePath(prefix, template, name string, labels snitch.Labels) string {
+	var b strings.Builder
+
+	if prefix != "" {
+		b.WriteString(prefix + ".")
+	}
+
+	used := make(map[string]struct{})
+
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			break
+		}
+
+		key := template[start+1 : start+end]
+		b.WriteString(template[:start])
+
+		if key == graphiteTemplateNameKey {
+			b.WriteString(sanitizeGraphiteName(name))
+		} else {
+			value := graphiteUnknownValue
+
+			for _, l := range labels {
+				if l.Key == key {
+					value = l.Value
+				}
+			}
+
+			b.WriteString(sanitizeGraphiteNode(value))
+			used[key] = struct{}{}
+		}
+
+		template = template[start+end+1:]
+	}
+
+	b.WriteString(template)
+
+	for _, l := range labels {
+		if _, ok := used[l.Key]; !ok {
+			b.WriteString("." + sanitizeGraphiteNode(l.Key) + "." + sanitizeGraphiteNode(l.Value))
+		}
+	}
+
+	return b.String()
+}
+
+func sanitizeGraphiteName(name string) string {
+	nodes := strings.Split(name, ".")
+	for i, node := range nodes {
+		nodes[i] = sanitizeGraphiteNode(node)
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+func sanitizeGraphiteNode(node string) string {
+	if node == "" {
+		return graphiteUnknownValue
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+
+		return '_'
+	}, node)
+}
+
+// encodeGraphitePickle encodes points as list of (path, (timestamp, value)) tuples with pickle protocol 2
+func encodeGraphitePickle(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+
+	buf.Write([]byte{0x80, 0x02, ']', '('})
+
+	number := make([]byte, 8)
+
+	for _, p := range points {
+		buf.WriteByte('X')
+		binary.LittleEndian.PutUint32(number[:4], uint32(len(p.path)))
+		buf.Write(number[:4])
+		buf.WriteString(p.path)
+
+		buf.WriteByte('G')
+		binary.BigEndian.PutUint64(number, math.Float64bits(float64(p.timestamp)))
+		buf.Write(number)
+
+		buf.WriteByte('G')
+		binary.BigEndian.PutUint64(number, math.Float64bits(p.value))
+		buf.Write(number)
+
+		buf.Write([]byte{0x86, 0x86})
+	}
+
+	buf.Write([]byte{'e', '.'})
+
+	message := make([]byte, 4+buf.Len())
+	binary.BigEndian.PutUint32(message, uint32(buf.Len()))
+	copy(message[4:], buf.Bytes())
+
+	return message
+}
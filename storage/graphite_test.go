@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+// decodeGraphitePickle unpickles the list of (path, (timestamp, value)) tuples,
+// only opcodes used by carbon clients are supported
+func decodeGraphitePickle(t *testing.T, payload []byte) []graphitePoint {
+	var (
+		stack []interface{}
+		marks []int
+	)
+
+	for i := 0; i < len(payload); {
+		op := payload[i]
+		i++
+
+		switch op {
+		case 0x80: // PROTO
+			i++
+
+		case ']': // EMPTY_LIST
+			stack = append(stack, []interface{}{})
+
+		case '(': // MARK
+			marks = append(marks, len(stack))
+
+		case 'X': // BINUNICODE
+			size := int(binary.LittleEndian.Uint32(payload[i:]))
+			stack = append(stack, string(payload[i+4:i+4+size]))
+			i += 4 + size
+
+		case 'G': // BINFLOAT
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(payload[i:])))
+			i += 8
+
+		case 0x86: // TUPLE2
+			n := len(stack)
+			stack = append(stack[:n-2], []interface{}{stack[n-2], stack[n-1]})
+
+		case 'e': // APPENDS
+			mark := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+
+			list := append(stack[mark-1].([]interface{}), stack[mark:]...)
+			stack = append(stack[:mark-1], list)
+
+		case '.': // STOP
+			points := make([]graphitePoint, 0)
+
+			for _, item := range stack[0].([]interface{}) {
+				tuple := item.([]interface{})
+				sample := tuple[1].([]interface{})
+
+				points = append(points, graphitePoint{
+					path:      tuple[0].(string),
+					timestamp: int64(sample[0].(float64)),
+					value:     sample[1].(float64),
+				})
+			}
+
+			return points
+
+		default:
+			t.Fatalf("unexpected opcode %x", op)
+		}
+	}
+
+	t.Fatal("pickle without stop")
+
+	return nil
+}
+
+func TestGraphitePickleRoundTrip(t *testing.T) {
+	points := []graphitePoint{
+		{path: "app.requests_total.code.200", value: 3, timestamp: 100},
+		{path: "app.temperature", value: -2.5, timestamp: 200},
+	}
+
+	message := encodeGraphitePickle(points)
+
+	if size := binary.BigEndian.Uint32(message); int(size) != len(message)-4 {
+		t.Fatalf("header of size %d for payload of %d bytes", size, len(message)-4)
+	}
+
+	decoded := decodeGraphitePickle(t, message[4:])
+
+	if len(decoded) != len(points) {
+		t.Fatalf("decoded %d points, expected %d", len(decoded), len(points))
+	}
+
+	for i := range points {
+		if decoded[i] != points[i] {
+			t.Fatalf("decoded %+v, expected %+v", decoded[i], points[i])
+		}
+	}
+}
+
+func TestGraphitePickleWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	s, err := NewGraphite("tcp", listener.Addr().String(), GraphiteProtocolPickle, "app", "{name}.{room}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauge := snitch.NewGauge("temperature", "", "room", "kitchen")
+	gauge.Set(21.5)
+
+	value, _ := gauge.Measure()
+
+	if err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: gauge.Description(),
+			CreatedAt:   time.Unix(100, 0),
+			Value:       value,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var message []byte
+
+	select {
+	case message = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("nothing is received")
+	}
+
+	if len(message) < 4 || int(binary.BigEndian.Uint32(message)) != len(message)-4 {
+		t.Fatal(io.ErrUnexpectedEOF)
+	}
+
+	points := decodeGraphitePickle(t, message[4:])
+	expected := graphitePoint{path: "app.temperature.kitchen", value: 21.5, timestamp: 100}
+
+	if len(points) != 1 || points[0] != expected {
+		t.Fatalf("points %+v, expected %+v", points, expected)
+	}
+}
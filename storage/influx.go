@@ -1,22 +1,52 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
-	"math"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
-	influxdb "github.com/influxdata/influxdb/client/v2"
 	"github.com/kihamo/snitch"
 	"github.com/pborman/uuid"
 )
 
+const (
+	DefaultInfluxUDPPayloadSize = 512
+
+	influxTimeout = 10 * time.Second
+)
+
+var (
+	influxQueryPrecision = map[time.Duration]string{
+		time.Nanosecond:  "n",
+		time.Microsecond: "u",
+		time.Millisecond: "ms",
+		time.Second:      "s",
+		time.Minute:      "m",
+		time.Hour:        "h",
+	}
+)
+
+// Influx writes measures in line protocol, url with udp scheme (udp://host:port)
+// sends points to UDP listener of InfluxDB or Telegraf, otherwise points are posted
+// to /write endpoint of InfluxDB 1.x HTTP API
 type Influx struct {
 	mutex sync.RWMutex
 
-	id     string
-	client influxdb.Client
-	config influxdb.BatchPointsConfig
-	labels snitch.Labels
+	id       string
+	client   *http.Client
+	url      *url.URL
+	database string
+	username string
+	password string
+	unit     time.Duration
+	labels   snitch.Labels
 }
 
 func NewInflux(url, database, username, password, precision string) (*Influx, error) {
@@ -30,6 +60,9 @@ func NewInfluxWithID(id, url, database, username, password, precision string) (*
 
 	storage := &Influx{
 		id: id,
+		client: &http.Client{
+			Timeout: influxTimeout,
+		},
 	}
 
 	err := storage.Reinitialization(url, database, username, password, precision)
@@ -46,131 +79,139 @@ func (s *Influx) ID() string {
 
 func (s *Influx) Write(measures snitch.Measures) error {
 	s.mutex.RLock()
-	bp, err := influxdb.NewBatchPoints(s.config)
+	u, database, username, password, unit := s.url, s.database, s.username, s.password, s.unit
 	globalLabels := s.labels
 	s.mutex.RUnlock()
 
-	if err != nil {
-		return err
-	}
-
-	var (
-		fieldsOne, fieldsTwo map[string]interface{}
-		point                *influxdb.Point
-	)
+	lines := make([][]byte, 0, len(measures))
 
 	for _, m := range measures {
 		if *(m.Value.SampleCount) == 0 {
 			continue
 		}
 
-		switch m.Description.Type() {
-		case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge:
-			if fieldsOne == nil {
-				fieldsOne = make(map[string]interface{}, 2)
-			}
-
-			if v := *(m.Value.Value); !math.IsNaN(v) {
-				fieldsOne["value"] = v
-			} else {
-				continue
-			}
+		fields := influxFields(m)
+		if len(fields) == 0 {
+			continue
+		}
 
-			fieldsOne["sample_count"] = float64(*(m.Value.SampleCount))
-
-			point, err = influxdb.NewPoint(
-				m.Description.Name(),
-				globalLabels.WithLabels(m.Description.Labels()).Map(),
-				fieldsOne,
-				m.CreatedAt)
-
-		case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
-			if fieldsTwo == nil {
-				fieldsTwo = make(map[string]interface{}, 5+100)
-			} else {
-				for i := range fieldsTwo {
-					delete(fieldsTwo, i)
-				}
-			}
+		var buf bytes.Buffer
 
-			fieldsTwo["sample_count"] = float64(*(m.Value.SampleCount))
+		writeInfluxLine(&buf, m.Description.Name(), mergeLabels(globalLabels, m.Description.Labels()), fields, m.CreatedAt, unit)
+		lines = append(lines, buf.Bytes())
+	}
 
-			if v := *(m.Value.SampleSum); !math.IsNaN(v) {
-				fieldsTwo["sample_sum"] = v
-			}
+	if len(lines) == 0 {
+		return nil
+	}
 
-			if v := *(m.Value.SampleMin); !math.IsNaN(v) {
-				fieldsTwo["sample_min"] = v
-			}
+	if u.Scheme == "udp" {
+		return s.writeUDP(u.Host, lines)
+	}
 
-			if v := *(m.Value.SampleMax); !math.IsNaN(v) {
-				fieldsTwo["sample_max"] = v
-			}
+	return s.writeHTTP(u, database, username, password, unit, bytes.Join(lines, nil))
+}
 
-			if v := *(m.Value.SampleVariance); !math.IsNaN(v) {
-				fieldsTwo["sample_variance"] = v
-			}
+func (s *Influx) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-			for q, v := range m.Value.Quantiles {
-				if !math.IsNaN(*v) {
-					fieldsTwo[fmt.Sprintf("p%.f", q*100)] = *v
-				}
-			}
+	s.labels = l
+}
 
-			point, err = influxdb.NewPoint(
-				m.Description.Name(),
-				globalLabels.WithLabels(m.Description.Labels()).Map(),
-				fieldsTwo,
-				m.CreatedAt)
+func (s *Influx) Reinitialization(addr, database, username, password, precision string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
 
-		default:
-			continue
+	switch u.Scheme {
+	case "udp":
+		if _, err = net.ResolveUDPAddr("udp", u.Host); err != nil {
+			return err
 		}
 
-		if err != nil {
-			return fmt.Errorf("failed create point for %s metric with labels %s because %v",
-				m.Description.Name(),
-				globalLabels.WithLabels(m.Description.Labels()).Map(),
-				err,
-			)
-		}
+	case "http", "https":
 
-		bp.AddPoint(point)
+	default:
+		return fmt.Errorf("unsupported protocol scheme %q of influx url", u.Scheme)
 	}
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	unit, err := influxPrecision(precision)
+	if err != nil {
+		return err
+	}
 
-	return s.client.Write(bp)
+	s.mutex.Lock()
+	s.url = u
+	s.database = database
+	s.username = username
+	s.password = password
+	s.unit = unit
+	s.mutex.Unlock()
+
+	return nil
 }
 
-func (s *Influx) SetLabels(l snitch.Labels) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *Influx) writeUDP(address string, lines [][]byte) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	s.labels = l
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line) > DefaultInfluxUDPPayloadSize {
+			if _, err = conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+		}
+
+		buf.Write(line)
+	}
+
+	_, err = conn.Write(buf.Bytes())
+
+	return err
 }
 
-func (s *Influx) Reinitialization(url, database, username, password, precision string) error {
-	client, err := influxdb.NewHTTPClient(influxdb.HTTPConfig{
-		Addr:     url,
-		Username: username,
-		Password: password,
-	})
+func (s *Influx) writeHTTP(u *url.URL, database, username, password string, unit time.Duration, body []byte) error {
+	endpoint := *u
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/write"
+
+	query := endpoint.Query()
+	query.Set("db", database)
+	query.Set("precision", influxQueryPrecision[unit])
+	endpoint.RawQuery = query.Encode()
 
+	request, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
-	config := influxdb.BatchPointsConfig{
-		Database:  database,
-		Precision: precision,
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if username != "" {
+		request.SetBasicAuth(username, password)
 	}
 
-	s.mutex.Lock()
-	s.client = client
-	s.config = config
-	s.mutex.Unlock()
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+
+		return fmt.Errorf("influx write failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
 
 	return nil
 }
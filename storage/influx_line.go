@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+var (
+	ErrInfluxUnknownPrecision = errors.New("unknown precision of influx timestamps")
+
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+type influxField struct {
+	key   string
+	value string
+}
+
+// influxPrecision returns duration of one unit of timestamp for the precision
+func influxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+
+	return 0, ErrInfluxUnknownPrecision
+}
+
+// influxFields converts measure to fields of point, all fields are floats to keep type
+// of fields written before, NaN and infinite values are skipped because line protocol
+// doesn't support them
+func influxFields(m *snitch.Measure) []influxField {
+	fields := make([]influxField, 0, 8)
+
+	addFloat := func(key string, v *float64) {
+		if v != nil && !math.IsNaN(*v) && !math.IsInf(*v, 0) {
+			fields = append(fields, influxField{key, strconv.FormatFloat(*v, 'f', -1, 64)})
+		}
+	}
+
+	addCount := func(key string, v *uint64) {
+		if v != nil {
+			fields = append(fields, influxField{key, strconv.FormatUint(*v, 10)})
+		}
+	}
+
+	switch m.Description.Type() {
+	case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge:
+		addFloat("value", m.Value.Value)
+
+		if len(fields) == 0 {
+			return nil
+		}
+
+		addCount("sample_count", m.Value.SampleCount)
+
+	case snitch.MetricTypeMeter:
+		addCount("sample_count", m.Value.SampleCount)
+		addFloat("rate_1", m.Value.Rate1)
+		addFloat("rate_5", m.Value.Rate5)
+		addFloat("rate_15", m.Value.Rate15)
+		addFloat("rate_mean", m.Value.RateMean)
+
+	case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+		addCount("sample_count", m.Value.SampleCount)
+		addFloat("sample_sum", m.Value.SampleSum)
+		addFloat("sample_min", m.Value.SampleMin)
+		addFloat("sample_max", m.Value.SampleMax)
+		addFloat("sample_variance", m.Value.SampleVariance)
+
+		for q, v := range m.Value.Quantiles {
+			addFloat(fmt.Sprintf("p%.f", q*100), v)
+		}
+
+		for le, v := range m.Value.Buckets {
+			addCount("bucket_"+formatBucketBound(le), v)
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+
+	return fields
+}
+
+// writeInfluxLine appends the point in line protocol to the buffer, timestamp is
+// omitted when unit is zero or time is not set
+func writeInfluxLine(buf *bytes.Buffer, measurement string, tags snitch.Labels, fields []influxField, t time.Time, unit time.Duration) {
+	buf.WriteString(influxMeasurementReplacer.Replace(measurement))
+
+	for _, tag := range tags {
+		// empty tag values are rejected by the server
+		if tag.Key == "" || tag.Value == "" {
+			continue
+		}
+
+		buf.WriteByte(',')
+		buf.WriteString(influxKeyReplacer.Replace(tag.Key))
+		buf.WriteByte('=')
+		buf.WriteString(influxKeyReplacer.Replace(tag.Value))
+	}
+
+	for i, field := range fields {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(influxKeyReplacer.Replace(field.key))
+		buf.WriteByte('=')
+		buf.WriteString(field.value)
+	}
+
+	if unit > 0 && !t.IsZero() {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(t.UnixNano()/int64(unit), 10))
+	}
+
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func TestInfluxLineEscaping(t *testing.T) {
+	tests := []struct {
+		name        string
+		measurement string
+		tags        snitch.Labels
+		fields      []influxField
+		expected    string
+	}{
+		{
+			"plain",
+			"temperature",
+			snitch.Labels{{Key: "room", Value: "hall"}},
+			[]influxField{{"value", "21.5"}},
+			"temperature,room=hall value=21.5\n",
+		},
+		{
+			"measurement",
+			"cpu load,total\nnow=1",
+			nil,
+			[]influxField{{"value", "1"}},
+			"cpu\\ load\\,total\\nnow=1 value=1\n",
+		},
+		{
+			"tag key and value",
+			"requests",
+			snitch.Labels{{Key: "host name", Value: "a=b,c d"}, {Key: "k=1,2", Value: "line\nbreak"}},
+			[]influxField{{"value", "1"}},
+			"requests,host\\ name=a\\=b\\,c\\ d,k\\=1\\,2=line\\nbreak value=1\n",
+		},
+		{
+			"field key",
+			"requests",
+			nil,
+			[]influxField{{"sample count", "1"}, {"p=50,x", "2"}},
+			"requests sample\\ count=1,p\\=50\\,x=2\n",
+		},
+		{
+			"empty tags",
+			"requests",
+			snitch.Labels{{Key: "code", Value: ""}, {Key: "", Value: "200"}, {Key: "path", Value: "/"}},
+			[]influxField{{"value", "1"}},
+			"requests,path=/ value=1\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+
+		writeInfluxLine(&buf, test.measurement, test.tags, test.fields, time.Time{}, time.Nanosecond)
+
+		if buf.String() != test.expected {
+			t.Fatalf("%s: line %q, expected %q", test.name, buf.String(), test.expected)
+		}
+	}
+}
+
+func TestInfluxLineTimestamp(t *testing.T) {
+	createdAt := time.Unix(7200, 123456789)
+
+	tests := []struct {
+		precision string
+		expected  string
+	}{
+		{"", "7200123456789"},
+		{"n", "7200123456789"},
+		{"ns", "7200123456789"},
+		{"u", "7200123456"},
+		{"us", "7200123456"},
+		{"µ", "7200123456"},
+		{"ms", "7200123"},
+		{"s", "7200"},
+		{"m", "120"},
+		{"h", "2"},
+	}
+
+	for _, test := range tests {
+		unit, err := influxPrecision(test.precision)
+		if err != nil {
+			t.Fatalf("precision %q: %v", test.precision, err)
+		}
+
+		var buf bytes.Buffer
+
+		writeInfluxLine(&buf, "requests", nil, []influxField{{"value", "1"}}, createdAt, unit)
+
+		if expected := "requests value=1 " + test.expected + "\n"; buf.String() != expected {
+			t.Fatalf("precision %q: line %q, expected %q", test.precision, buf.String(), expected)
+		}
+	}
+
+	if _, err := influxPrecision("d"); err != ErrInfluxUnknownPrecision {
+		t.Fatalf("error %v of unknown precision, expected %v", err, ErrInfluxUnknownPrecision)
+	}
+
+	var buf bytes.Buffer
+
+	writeInfluxLine(&buf, "requests", nil, []influxField{{"value", "1"}}, time.Time{}, time.Second)
+
+	if buf.String() != "requests value=1\n" {
+		t.Fatalf("line %q of zero time has timestamp", buf.String())
+	}
+}
+
+func TestInfluxFieldsBuckets(t *testing.T) {
+	histogram := snitch.NewBucketedHistogram("latency_seconds", "", []float64{0.5, 1})
+	histogram.Add(0.5)
+	histogram.Add(2)
+
+	var buf bytes.Buffer
+
+	m := testMeasures(histogram)[0]
+	writeInfluxLine(&buf, m.Description.Name(), nil, influxFields(m), m.CreatedAt, time.Second)
+
+	expected := "latency_seconds bucket_+Inf=2,bucket_0.5=1,bucket_1=1,sample_count=2,sample_max=2,sample_min=0.5,sample_sum=2.5,sample_variance=0.5625 100\n"
+
+	if buf.String() != expected {
+		t.Fatalf("line %q, expected %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func influxMeasures(count int) snitch.Measures {
+	measures := make(snitch.Measures, 0, count)
+
+	for i := 0; i < count; i++ {
+		measures = append(measures, &snitch.Measure{
+			Description: snitch.NewDescription("temperature", "", snitch.MetricTypeGauge, "sensor", fmt.Sprintf("sensor-%03d", i)),
+			CreatedAt:   time.Unix(100, 0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(float64(i)),
+				SampleCount: snitch.Uint64(1),
+			},
+		})
+	}
+
+	return measures
+}
+
+func TestInfluxHTTP(t *testing.T) {
+	var (
+		path, query, body, contentType string
+		username, password             string
+		auth                           bool
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		path, query, body = r.URL.Path, r.URL.RawQuery, string(b)
+		contentType = r.Header.Get("Content-Type")
+		username, password, auth = r.BasicAuth()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s, err := NewInflux(server.URL+"/influx/", "metrics", "user", "secret", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}})
+
+	if err = s.Write(influxMeasures(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/influx/write" || query != "db=metrics&precision=s" {
+		t.Fatalf("unexpected request to %s?%s", path, query)
+	}
+
+	if !auth || username != "user" || password != "secret" {
+		t.Fatalf("unexpected basic auth %q:%q", username, password)
+	}
+
+	if contentType != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	expected := "temperature,host=h,sensor=sensor-000 sample_count=1,value=0 100\n" +
+		"temperature,host=h,sensor=sensor-001 sample_count=1,value=1 100\n"
+
+	if body != expected {
+		t.Fatalf("body %q, expected %q", body, expected)
+	}
+}
+
+func TestInfluxHTTPFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Error("basic auth is sent without username")
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"database not found"}`))
+	}))
+	defer server.Close()
+
+	s, err := NewInflux(server.URL, "metrics", "", "", "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Write(influxMeasures(1))
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "database not found") {
+		t.Fatalf("expected error with status and message, got %v", err)
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewInflux("udp://"+conn.LocalAddr().String(), "", "", "", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Write(influxMeasures(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readUDP(t, conn)
+	if len(packets) < 2 {
+		t.Fatalf("%d packets, expected payload to be split", len(packets))
+	}
+
+	lines := make([]string, 0, 20)
+
+	for _, packet := range packets {
+		if len(packet) > DefaultInfluxUDPPayloadSize {
+			t.Fatalf("packet of %d bytes exceeds %d", len(packet), DefaultInfluxUDPPayloadSize)
+		}
+
+		if !strings.HasSuffix(packet, "\n") {
+			t.Fatalf("packet %q is split in the middle of line", packet)
+		}
+
+		lines = append(lines, strings.Split(strings.TrimSuffix(packet, "\n"), "\n")...)
+	}
+
+	if len(lines) != 20 {
+		t.Fatalf("%d lines received, expected 20", len(lines))
+	}
+
+	for i, line := range lines {
+		if expected := fmt.Sprintf("temperature,sensor=sensor-%03d sample_count=1,value=%d 100", i, i); line != expected {
+			t.Fatalf("line %q, expected %q", line, expected)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	DefaultInfluxV2BatchSize = 5000
+)
+
+var (
+	influxV2QueryPrecision = map[time.Duration]string{
+		time.Nanosecond:  "ns",
+		time.Microsecond: "us",
+		time.Millisecond: "ms",
+		time.Second:      "s",
+	}
+)
+
+type InfluxV2Option func(*InfluxV2)
+
+// InfluxV2 writes measures in line protocol to /api/v2/write endpoint
+// of InfluxDB 2.x and 3.x with token authentication
+type InfluxV2 struct {
+	mutex sync.RWMutex
+
+	id        string
+	client    *http.Client
+	url       *url.URL
+	org       string
+	bucket    string
+	token     string
+	unit      time.Duration
+	batchSize int
+	gzip      bool
+	labels    snitch.Labels
+}
+
+func WithInfluxV2BatchSize(size int) InfluxV2Option {
+	return func(s *InfluxV2) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+func WithInfluxV2Gzip(enabled bool) InfluxV2Option {
+	return func(s *InfluxV2) {
+		s.gzip = enabled
+	}
+}
+
+func NewInfluxV2(url, org, bucket, token, precision string, opts ...InfluxV2Option) (*InfluxV2, error) {
+	return NewInfluxV2WithID("", url, org, bucket, token, precision, opts...)
+}
+
+func NewInfluxV2WithID(id, url, org, bucket, token, precision string, opts ...InfluxV2Option) (*InfluxV2, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &InfluxV2{
+		id: id,
+		client: &http.Client{
+			Timeout: influxTimeout,
+		},
+		batchSize: DefaultInfluxV2BatchSize,
+		gzip:      true,
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := storage.Reinitialization(url, org, bucket, token, precision)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *InfluxV2) ID() string {
+	return s.id
+}
+
+func (s *InfluxV2) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	u, org, bucket, token, unit := s.url, s.org, s.bucket, s.token, s.unit
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	endpoint := *u
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/api/v2/write"
+
+	query := endpoint.Query()
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", influxV2QueryPrecision[unit])
+	endpoint.RawQuery = query.Encode()
+
+	var (
+		buf    bytes.Buffer
+		points int
+	)
+
+	for _, m := range measures {
+		if *(m.Value.SampleCount) == 0 {
+			continue
+		}
+
+		fields := influxFields(m)
+		if len(fields) == 0 {
+			continue
+		}
+
+		writeInfluxLine(&buf, m.Description.Name(), mergeLabels(globalLabels, m.Description.Labels()), fields, m.CreatedAt, unit)
+		points++
+
+		if points == s.batchSize {
+			if err := s.post(endpoint.String(), token, buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+			points = 0
+		}
+	}
+
+	if points == 0 {
+		return nil
+	}
+
+	return s.post(endpoint.String(), token, buf.Bytes())
+}
+
+func (s *InfluxV2) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *InfluxV2) Reinitialization(addr, org, bucket, token, precision string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported protocol scheme %q of influx url", u.Scheme)
+	}
+
+	if bucket == "" {
+		return errors.New("influx bucket is empty")
+	}
+
+	unit, err := influxPrecision(precision)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := influxV2QueryPrecision[unit]; !ok {
+		return ErrInfluxUnknownPrecision
+	}
+
+	s.mutex.Lock()
+	s.url = u
+	s.org = org
+	s.bucket = bucket
+	s.token = token
+	s.unit = unit
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *InfluxV2) post(endpoint, token string, body []byte) error {
+	if s.gzip {
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		body = buf.Bytes()
+	}
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if s.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if token != "" {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+
+		return fmt.Errorf("influx write failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+type influxV2Request struct {
+	query         string
+	authorization string
+	encoding      string
+	body          string
+}
+
+func TestInfluxV2Write(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		requests []influxV2Request
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(reader)
+
+		mutex.Lock()
+		requests = append(requests, influxV2Request{
+			query:         r.URL.RawQuery,
+			authorization: r.Header.Get("Authorization"),
+			encoding:      r.Header.Get("Content-Encoding"),
+			body:          string(body),
+		})
+		mutex.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s, err := NewInfluxV2(server.URL, "my org", "metrics", "secret", "s", WithInfluxV2BatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measures := make(snitch.Measures, 0, 3)
+
+	for i, room := range []string{"kitchen", "hall", "bedroom"} {
+		measures = append(measures, &snitch.Measure{
+			Description: snitch.NewDescription("temperature", "", snitch.MetricTypeGauge, "room", room),
+			CreatedAt:   time.Unix(100, 0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(float64(20 + i)),
+				SampleCount: snitch.Uint64(1),
+			},
+		})
+	}
+
+	if err = s.Write(measures); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, expected 2 batches", len(requests))
+	}
+
+	bodies := make([]string, 0, len(requests))
+
+	for _, r := range requests {
+		if r.query != "bucket=metrics&org=my+org&precision=s" {
+			t.Fatalf("unexpected query %s", r.query)
+		}
+
+		if r.authorization != "Token secret" {
+			t.Fatalf("unexpected authorization %q", r.authorization)
+		}
+
+		if r.encoding != "gzip" {
+			t.Fatalf("unexpected encoding %q", r.encoding)
+		}
+
+		bodies = append(bodies, r.body)
+	}
+
+	expected := []string{
+		"temperature,room=kitchen sample_count=1,value=20 100\ntemperature,room=hall sample_count=1,value=21 100\n",
+		"temperature,room=bedroom sample_count=1,value=22 100\n",
+	}
+
+	if strings.Join(bodies, "|") != strings.Join(expected, "|") {
+		t.Fatalf("bodies %q, expected %q", bodies, expected)
+	}
+}
+
+func TestInfluxV2WriteFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"code":"unauthorized"}`))
+	}))
+	defer server.Close()
+
+	s, err := NewInfluxV2(server.URL, "org", "bucket", "invalid", "ns", WithInfluxV2Gzip(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescription("requests_total", "", snitch.MetricTypeCounter),
+			CreatedAt:   time.Now(),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(1),
+				SampleCount: snitch.Uint64(1),
+			},
+		},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected error with status, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/kihamo/snitch"
+)
+
+// mergeLabels returns a new sorted list of labels, metric labels override global labels with the same key
+func mergeLabels(global, metric snitch.Labels) snitch.Labels {
+	index := make(map[string]int, len(global)+len(metric))
+	ret := make(snitch.Labels, 0, len(global)+len(metric))
+
+	for _, labels := range []snitch.Labels{global, metric} {
+		for _, l := range labels {
+			if i, ok := index[l.Key]; ok {
+				ret[i] = &snitch.Label{Key: l.Key, Value: l.Value}
+				continue
+			}
+
+			index[l.Key] = len(ret)
+			ret = append(ret, &snitch.Label{Key: l.Key, Value: l.Value})
+		}
+	}
+
+	sort.Sort(ret)
+
+	return ret
+}
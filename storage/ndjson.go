@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	DefaultNDJSONMaxSize   = 64 << 20
+	DefaultNDJSONRetention = 7
+
+	ndjsonRotateTimeFormat = "20060102T150405.000000000"
+	ndjsonCompressExt      = ".gz"
+)
+
+type NDJSONOption func(*NDJSON)
+
+// ndjsonFloat is written as null if value is NaN or infinite
+type ndjsonFloat float64
+
+type ndjsonRecord struct {
+	Name           string                 `json:"name"`
+	Type           string                 `json:"type"`
+	Help           string                 `json:"help,omitempty"`
+	Labels         map[string]string      `json:"labels"`
+	CreatedAt      time.Time              `json:"created_at"`
+	Value          *ndjsonFloat           `json:"value,omitempty"`
+	SampleCount    *uint64                `json:"sample_count,omitempty"`
+	SampleSum      *ndjsonFloat           `json:"sample_sum,omitempty"`
+	SampleMin      *ndjsonFloat           `json:"sample_min,omitempty"`
+	SampleMax      *ndjsonFloat           `json:"sample_max,omitempty"`
+	SampleVariance *ndjsonFloat           `json:"sample_variance,omitempty"`
+	Quantiles      map[string]ndjsonFloat `json:"quantiles,omitempty"`
+	Buckets        map[string]uint64      `json:"buckets,omitempty"`
+	Rate1          *ndjsonFloat           `json:"rate_1,omitempty"`
+	Rate5          *ndjsonFloat           `json:"rate_5,omitempty"`
+	Rate15         *ndjsonFloat           `json:"rate_15,omitempty"`
+	RateMean       *ndjsonFloat           `json:"rate_mean,omitempty"`
+}
+
+// NDJSON appends measures to the file as newline delimited JSON records, one record
+// per measure. The file is rotated by size or age, rotated files are renamed with
+// the time of rotation, optionally compressed, and only the newest of them are kept
+type NDJSON struct {
+	mutex sync.Mutex
+
+	id        string
+	path      string
+	maxSize   int64
+	maxAge    time.Duration
+	compress  bool
+	retention int
+	labels    snitch.Labels
+
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	archiveErr error
+}
+
+func WithNDJSONMaxSize(size int64) NDJSONOption {
+	return func(s *NDJSON) {
+		s.maxSize = size
+	}
+}
+
+func WithNDJSONMaxAge(d time.Duration) NDJSONOption {
+	return func(s *NDJSON) {
+		s.maxAge = d
+	}
+}
+
+func WithNDJSONCompress(enabled bool) NDJSONOption {
+	return func(s *NDJSON) {
+		s.compress = enabled
+	}
+}
+
+func WithNDJSONRetention(count int) NDJSONOption {
+	return func(s *NDJSON) {
+		s.retention = count
+	}
+}
+
+func NewNDJSON(path string, opts ...NDJSONOption) (*NDJSON, error) {
+	return NewNDJSONWithID("", path, opts...)
+}
+
+func NewNDJSONWithID(id, path string, opts ...NDJSONOption) (*NDJSON, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &NDJSON{
+		id:        id,
+		path:      path,
+		maxSize:   DefaultNDJSONMaxSize,
+		retention: DefaultNDJSONRetention,
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := storage.open(); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *NDJSON) ID() string {
+	return s.id
+}
+
+func (s *NDJSON) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	for _, m := range measures {
+		if err := encoder.Encode(newNDJSONRecord(m, s.labels)); err != nil {
+			return err
+		}
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	var rotated string
+
+	if s.size > 0 && ((s.maxSize > 0 && s.size+int64(buf.Len()) > s.maxSize) || (s.maxAge > 0 && time.Since(s.openedAt) >= s.maxAge)) {
+		var err error
+
+		if rotated, err = s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+
+	if err != nil || rotated == "" {
+		return err
+	}
+
+	// the batch is already written, failed compressing or cleanup only leaves rotated files as is
+	s.archiveErr = s.archive(rotated)
+
+	return nil
+}
+
+func (s *NDJSON) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+// Rotate closes current file and starts a new one
+func (s *NDJSON) Rotate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	rotated, err := s.rotate()
+	if err != nil {
+		return err
+	}
+
+	s.archiveErr = s.archive(rotated)
+
+	return s.archiveErr
+}
+
+// ArchiveError returns error of compressing or cleanup after the last rotation,
+// Write doesn't return it because the batch is written anyway
+func (s *NDJSON) ArchiveError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.archiveErr
+}
+
+func (s *NDJSON) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *NDJSON) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	s.openedAt = time.Now()
+
+	return nil
+}
+
+// rotate renames current file and opens a new one, returns path of rotated file
+func (s *NDJSON) rotate() (string, error) {
+	if err := s.file.Close(); err != nil {
+		return "", err
+	}
+
+	s.file = nil
+
+	rotated := s.path + "." + time.Now().Format(ndjsonRotateTimeFormat)
+	if err := os.Rename(s.path, rotated); err != nil {
+		return "", err
+	}
+
+	if err := s.open(); err != nil {
+		return "", err
+	}
+
+	return rotated, nil
+}
+
+// archive compresses rotated file and removes the oldest ones
+func (s *NDJSON) archive(rotated string) error {
+	if s.compress {
+		if err := compressNDJSON(rotated); err != nil {
+			return err
+		}
+	}
+
+	return s.cleanup()
+}
+
+// cleanup removes the oldest rotated files over the retention count
+func (s *NDJSON) cleanup() error {
+	if s.retention <= 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	rotated := files[:0]
+
+	for _, f := range files {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(f, s.path+"."), ndjsonCompressExt)
+
+		if _, err := time.Parse(ndjsonRotateTimeFormat, suffix); err == nil {
+			rotated = append(rotated, f)
+		}
+	}
+
+	sort.Strings(rotated)
+
+	for len(rotated) > s.retention {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+func compressNDJSON(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+ndjsonCompressExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(path + ndjsonCompressExt)
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func newNDJSONRecord(m *snitch.Measure, global snitch.Labels) *ndjsonRecord {
+	record := &ndjsonRecord{
+		Name:           m.Description.Name(),
+		Type:           m.Description.Type().String(),
+		Help:           m.Description.Help(),
+		Labels:         make(map[string]string),
+		CreatedAt:      m.CreatedAt,
+		Value:          (*ndjsonFloat)(m.Value.Value),
+		SampleCount:    m.Value.SampleCount,
+		SampleSum:      (*ndjsonFloat)(m.Value.SampleSum),
+		SampleMin:      (*ndjsonFloat)(m.Value.SampleMin),
+		SampleMax:      (*ndjsonFloat)(m.Value.SampleMax),
+		SampleVariance: (*ndjsonFloat)(m.Value.SampleVariance),
+		Rate1:          (*ndjsonFloat)(m.Value.Rate1),
+		Rate5:          (*ndjsonFloat)(m.Value.Rate5),
+		Rate15:         (*ndjsonFloat)(m.Value.Rate15),
+		RateMean:       (*ndjsonFloat)(m.Value.RateMean),
+	}
+
+	for _, l := range mergeLabels(global, m.Description.Labels()) {
+		record.Labels[l.Key] = l.Value
+	}
+
+	if len(m.Value.Quantiles) > 0 {
+		record.Quantiles = make(map[string]ndjsonFloat, len(m.Value.Quantiles))
+
+		for q, v := range m.Value.Quantiles {
+			record.Quantiles[strconv.FormatFloat(q, 'g', -1, 64)] = ndjsonFloat(*v)
+		}
+	}
+
+	if len(m.Value.Buckets) > 0 {
+		record.Buckets = make(map[string]uint64, len(m.Value.Buckets))
+
+		for le, v := range m.Value.Buckets {
+			record.Buckets[formatBucketBound(le)] = *v
+		}
+	}
+
+	return record
+}
+
+func (f ndjsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte("null"), nil
+	}
+
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+// ndjsonRotated returns rotated files sorted from the oldest one
+func ndjsonRotated(t *testing.T, path string) []string {
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+func readNDJSON(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var b []byte
+
+	if strings.HasSuffix(path, ndjsonCompressExt) {
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err = ioutil.ReadAll(r)
+	} else {
+		b, err = ioutil.ReadAll(f)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]map[string]interface{}, 0)
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		record := make(map[string]interface{})
+
+		if err = json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %q isn't JSON: %v", line, err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestNDJSONRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+
+	s, err := NewNDJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}, {Key: "room", Value: "global"}})
+
+	if err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescription("temperature", "Temperature", snitch.MetricTypeGauge, "room", "hall"),
+			CreatedAt:   time.Unix(100, 0).UTC(),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(math.NaN()),
+				SampleCount: snitch.Uint64(1),
+			},
+		},
+		&snitch.Measure{
+			Description: snitch.NewDescription("latency_seconds", "", snitch.MetricTypeHistogram),
+			CreatedAt:   time.Unix(100, 0).UTC(),
+			Value: &snitch.MeasureValue{
+				SampleCount: snitch.Uint64(2),
+				SampleSum:   snitch.Float64(math.Inf(+1)),
+				Quantiles: map[float64]*float64{
+					0.5: snitch.Float64(math.NaN()),
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"name":"temperature","type":"gauge","help":"Temperature","labels":{"host":"h","room":"hall"},"created_at":"1970-01-01T00:01:40Z","value":null,"sample_count":1}` + "\n" +
+		`{"name":"latency_seconds","type":"histogram","labels":{"host":"h","room":"global"},"created_at":"1970-01-01T00:01:40Z","sample_count":2,"sample_sum":null,"quantiles":{"0.5":null}}` + "\n"
+
+	if string(b) != expected {
+		t.Fatalf("file:\n%s\nexpected:\n%s", b, expected)
+	}
+}
+
+func TestNDJSONRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+
+	s, err := NewNDJSON(path, WithNDJSONMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"first", "second", "third"} {
+		if err = s.Write(append(testBatch(name), testBatch(name)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated := ndjsonRotated(t, path)
+	if len(rotated) != 2 {
+		t.Fatalf("%d rotated files, expected 2", len(rotated))
+	}
+
+	for i, name := range []string{"first", "second"} {
+		records := readNDJSON(t, rotated[i])
+		if len(records) != 2 || records[0]["name"] != name {
+			t.Fatalf("rotated file %s has %v, expected two records of %s", rotated[i], records, name)
+		}
+	}
+
+	records := readNDJSON(t, path)
+	if len(records) != 2 || records[0]["name"] != "third" {
+		t.Fatalf("current file has %v, expected two records of third", records)
+	}
+}
+
+func TestNDJSONRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+
+	s, err := NewNDJSON(path, WithNDJSONMaxAge(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write(testBatch("first"))
+	s.Write(testBatch("second"))
+
+	if rotated := ndjsonRotated(t, path); len(rotated) != 0 {
+		t.Fatalf("file is rotated before max age: %v", rotated)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	s.Write(testBatch("third"))
+
+	rotated := ndjsonRotated(t, path)
+	if len(rotated) != 1 {
+		t.Fatalf("%d rotated files, expected 1", len(rotated))
+	}
+
+	if records := readNDJSON(t, rotated[0]); len(records) != 2 {
+		t.Fatalf("rotated file has %d records, expected 2", len(records))
+	}
+
+	if records := readNDJSON(t, path); len(records) != 1 || records[0]["name"] != "third" {
+		t.Fatalf("current file has %v, expected third", records)
+	}
+}
+
+func TestNDJSONCompressAndRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+
+	s, err := NewNDJSON(path, WithNDJSONCompress(true), WithNDJSONRetention(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		s.Write(testBatch(name))
+
+		if err = s.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated := ndjsonRotated(t, path)
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files %v, expected 2 newest", rotated)
+	}
+
+	for i, name := range []string{"third", "fourth"} {
+		if !strings.HasSuffix(rotated[i], ndjsonCompressExt) {
+			t.Fatalf("rotated file %s isn't compressed", rotated[i])
+		}
+
+		if records := readNDJSON(t, rotated[i]); len(records) != 1 || records[0]["name"] != name {
+			t.Fatalf("rotated file %s has %v, expected %s", rotated[i], records, name)
+		}
+	}
+}
+
+func TestNDJSONArchiveError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+
+	// the oldest rotated file can't be removed because it is not empty directory
+	blocked := path + ".20000101T000000.000000000"
+
+	if err := os.MkdirAll(filepath.Join(blocked, "file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewNDJSON(path, WithNDJSONMaxSize(1), WithNDJSONRetention(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write(testBatch("first"))
+
+	if err = s.Write(testBatch("second")); err != nil {
+		t.Fatalf("write returned error %v of cleanup", err)
+	}
+
+	if s.ArchiveError() == nil {
+		t.Fatal("error of cleanup isn't kept")
+	}
+
+	if records := readNDJSON(t, path); len(records) != 1 || records[0]["name"] != "second" {
+		t.Fatalf("current file has %v, expected second", records)
+	}
+
+	if err = os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Write(testBatch("third"))
+
+	if err = s.ArchiveError(); err != nil {
+		t.Fatalf("error %v is kept after successful cleanup", err)
+	}
+}
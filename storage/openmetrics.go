@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+const (
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	openMetricsMediaType = "application/openmetrics-text"
+)
+
+var (
+	openMetricsHelpReplacer = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+func writeOpenMetricsText(w io.Writer, measures snitch.Measures, labels snitch.Labels) error {
+	var b strings.Builder
+
+	for _, family := range prometheusFamilies(measures, labels) {
+		name := family.name
+		if t := family.description.Type(); t == snitch.MetricTypeCounter || t == snitch.MetricTypeMeter {
+			name = strings.TrimSuffix(name, "_total")
+		}
+
+		switch family.description.Type() {
+		case snitch.MetricTypeCounter, snitch.MetricTypeMeter:
+			b.WriteString("# TYPE " + name + " counter\n")
+		case snitch.MetricTypeGauge:
+			b.WriteString("# TYPE " + name + " gauge\n")
+		case snitch.MetricTypeUntyped:
+			b.WriteString("# TYPE " + name + " unknown\n")
+		case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+			if family.bucketed() {
+				b.WriteString("# TYPE " + name + " histogram\n")
+			} else {
+				b.WriteString("# TYPE " + name + " summary\n")
+			}
+		}
+
+		if unit := family.description.Unit(); unit != "" && strings.HasSuffix(name, "_"+unit) {
+			b.WriteString("# UNIT " + name + " " + unit + "\n")
+		}
+
+		if help := family.description.Help(); help != "" {
+			b.WriteString("# HELP " + name + " " + openMetricsHelpReplacer.Replace(help) + "\n")
+		}
+
+		for _, series := range family.series {
+			switch family.description.Type() {
+			case snitch.MetricTypeCounter, snitch.MetricTypeMeter:
+				writePrometheusSample(&b, name+"_total", series.labels, *(series.value.Value))
+				writeOpenMetricsCreated(&b, name, series)
+
+			case snitch.MetricTypeGauge, snitch.MetricTypeUntyped:
+				writePrometheusSample(&b, name, series.labels, *(series.value.Value))
+
+			case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+				writePrometheusDistribution(&b, name, series)
+
+				sum := *(series.value.SampleSum)
+				if math.IsNaN(sum) {
+					sum = 0
+				}
+
+				writePrometheusSample(&b, name+"_sum", series.labels, sum)
+				writePrometheusSample(&b, name+"_count", series.labels, float64(*(series.value.SampleCount)))
+				writeOpenMetricsCreated(&b, name, series)
+			}
+		}
+	}
+
+	b.WriteString("# EOF\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func writeOpenMetricsCreated(b *strings.Builder, name string, series *prometheusSeries) {
+	if series.createdAt.IsZero() {
+		return
+	}
+
+	writePrometheusSample(b, name+"_created", series.labels, openMetricsTimestamp(series.createdAt))
+}
+
+func openMetricsTimestamp(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// acceptOpenMetrics reports whether the Accept header prefers OpenMetrics over the Prometheus text format
+func acceptOpenMetrics(accept string) bool {
+	var openMetrics, text float64
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case openMetricsMediaType:
+			if q > openMetrics {
+				openMetrics = q
+			}
+
+		case "text/plain", "text/*", "*/*":
+			if q > text {
+				text = q
+			}
+		}
+	}
+
+	return openMetrics > 0 && openMetrics >= text
+}
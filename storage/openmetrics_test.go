@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestPrometheusExpositionOpenMetrics(t *testing.T) {
+	contentType, body := serveExposition(t, "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+
+	if contentType != OpenMetricsContentType {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	expected := `# TYPE latency_seconds summary
+# UNIT latency_seconds seconds
+# HELP latency_seconds Latency
+latency_seconds{host="h",quantile="0.5"} 0.5
+latency_seconds{host="h",quantile="0.9"} 1
+latency_seconds_sum{host="h"} 1.5
+latency_seconds_count{host="h"} 2
+latency_seconds_created{host="h"} 100.5
+# TYPE requests counter
+# HELP requests Requests\nserved
+requests_total{code="200",host="h"} 3
+requests_created{code="200",host="h"} 100.5
+# TYPE temperature_celsius gauge
+# UNIT temperature_celsius celsius
+temperature_celsius{host="h",room="\"hall\""} 21.5
+# EOF
+`
+
+	if body != expected {
+		t.Fatalf("body:\n%s\nexpected:\n%s", body, expected)
+	}
+}
+
+func TestAcceptOpenMetrics(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                             false,
+		"*/*":                          false,
+		"application/openmetrics-text": true,
+		"application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.9": false,
+		"text/plain;q=0.1,application/openmetrics-text;q=0.2":                             true,
+		"application/openmetrics-text;q=0":                                                false,
+	} {
+		if acceptOpenMetrics(accept) != expected {
+			t.Fatalf("accept %q: expected %v", accept, expected)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// OpenTSDBTagOverflowDrop keeps labels of metric first and drops the rest of tags
+	OpenTSDBTagOverflowDrop OpenTSDBTagOverflow = iota
+	// OpenTSDBTagOverflowSkip skips measures with too many tags
+	OpenTSDBTagOverflowSkip
+	// OpenTSDBTagOverflowError fails whole write
+	OpenTSDBTagOverflowError
+
+	DefaultOpenTSDBMaxTags = 8
+	// without tsd.http.request.enable_chunked the body of request is limited by 4KB
+	DefaultOpenTSDBBatchSize = 20
+
+	openTSDBTimeout  = 10 * time.Second
+	openTSDBTypeTag  = "type"
+	openTSDBTagEmpty = "unknown"
+)
+
+var (
+	ErrOpenTSDBTooManyTags = errors.New("too many tags for opentsdb")
+)
+
+type OpenTSDBTagOverflow int
+
+type OpenTSDBOption func(*OpenTSDB)
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// OpenTSDB puts measures to /api/put endpoint, url with tcp scheme (tcp://host:4242)
+// sends them by telnet put command. Fields of histograms, timers and meters are
+// sent as metrics with suffixes such as name.count or name.p99
+type OpenTSDB struct {
+	mutex sync.RWMutex
+
+	id        string
+	client    *http.Client
+	url       *url.URL
+	maxTags   int
+	overflow  OpenTSDBTagOverflow
+	batchSize int
+	labels    snitch.Labels
+}
+
+func WithOpenTSDBMaxTags(max int, overflow OpenTSDBTagOverflow) OpenTSDBOption {
+	return func(s *OpenTSDB) {
+		if max > 0 {
+			s.maxTags = max
+		}
+
+		s.overflow = overflow
+	}
+}
+
+func WithOpenTSDBBatchSize(size int) OpenTSDBOption {
+	return func(s *OpenTSDB) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+func NewOpenTSDB(url string, opts ...OpenTSDBOption) (*OpenTSDB, error) {
+	return NewOpenTSDBWithID("", url, opts...)
+}
+
+func NewOpenTSDBWithID(id, url string, opts ...OpenTSDBOption) (*OpenTSDB, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &OpenTSDB{
+		id: id,
+		client: &http.Client{
+			Timeout: openTSDBTimeout,
+		},
+		maxTags:   DefaultOpenTSDBMaxTags,
+		overflow:  OpenTSDBTagOverflowDrop,
+		batchSize: DefaultOpenTSDBBatchSize,
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := storage.Reinitialization(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *OpenTSDB) ID() string {
+	return s.id
+}
+
+func (s *OpenTSDB) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	u := s.url
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	points := make([]*openTSDBPoint, 0, len(measures))
+
+	for _, m := range measures {
+		if *(m.Value.SampleCount) == 0 {
+			continue
+		}
+
+		tags, ok := openTSDBTags(m, globalLabels, s.maxTags)
+		if !ok {
+			switch s.overflow {
+			case OpenTSDBTagOverflowSkip:
+				continue
+			case OpenTSDBTagOverflowError:
+				return fmt.Errorf("failed put %s metric because %v", m.Description.Name(), ErrOpenTSDBTooManyTags)
+			}
+		}
+
+		name := sanitizeOpenTSDB(m.Description.Name())
+		timestamp := m.CreatedAt.UnixNano() / int64(time.Millisecond)
+
+		for _, field := range measureFields(m) {
+			if math.IsInf(field.value, 0) {
+				continue
+			}
+
+			metric := name
+			if field.suffix != "" {
+				metric += "." + sanitizeOpenTSDB(field.suffix)
+			}
+
+			points = append(points, &openTSDBPoint{
+				Metric:    metric,
+				Timestamp: timestamp,
+				Value:     field.value,
+				Tags:      tags,
+			})
+		}
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	if u.Scheme == "tcp" {
+		return s.writeTelnet(u.Host, points)
+	}
+
+	endpoint := *u
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/api/put"
+
+	for i := 0; i < len(points); i += s.batchSize {
+		end := i + s.batchSize
+		if end > len(points) {
+			end = len(points)
+		}
+
+		if err := s.writeHTTP(endpoint.String(), points[i:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *OpenTSDB) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *OpenTSDB) Reinitialization(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if _, err = net.ResolveTCPAddr("tcp", u.Host); err != nil {
+			return err
+		}
+
+	case "http", "https":
+
+	default:
+		return fmt.Errorf("unsupported protocol scheme %q of opentsdb url", u.Scheme)
+	}
+
+	s.mutex.Lock()
+	s.url = u
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *OpenTSDB) writeHTTP(endpoint string, points []*openTSDBPoint) error {
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+
+		return fmt.Errorf("opentsdb put failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+
+	return nil
+}
+
+func (s *OpenTSDB) writeTelnet(address string, points []*openTSDBPoint) error {
+	conn, err := net.DialTimeout("tcp", address, openTSDBTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetWriteDeadline(time.Now().Add(openTSDBTimeout)); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	for _, p := range points {
+		buf.WriteString("put " + p.Metric + " " + strconv.FormatInt(p.Timestamp, 10) + " " + strconv.FormatFloat(p.Value, 'f', -1, 64))
+
+		keys := make([]string, 0, len(p.Tags))
+		for key := range p.Tags {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buf.WriteString(" " + key + "=" + p.Tags[key])
+		}
+
+		buf.WriteByte('\n')
+	}
+
+	_, err = buf.WriteTo(conn)
+
+	return err
+}
+
+// openTSDBTags returns sanitized tags of measure, labels of metric take precedence over
+// global labels when the number of tags exceeds the limit. At least one tag is required
+// by OpenTSDB, so the type of metric is used for measures without labels
+func openTSDBTags(m *snitch.Measure, global snitch.Labels, max int) (map[string]string, bool) {
+	tags := make(map[string]string, max)
+	ok := true
+
+	add := func(labels snitch.Labels) {
+		for _, l := range mergeLabels(nil, labels) {
+			key := sanitizeOpenTSDB(l.Key)
+
+			if _, exists := tags[key]; exists {
+				continue
+			}
+
+			if len(tags) >= max {
+				ok = false
+				continue
+			}
+
+			tags[key] = sanitizeOpenTSDB(l.Value)
+		}
+	}
+
+	add(m.Description.Labels())
+	add(global)
+
+	if len(tags) == 0 {
+		tags[openTSDBTypeTag] = m.Description.Type().String()
+	}
+
+	return tags, ok
+}
+
+func sanitizeOpenTSDB(s string) string {
+	if s == "" {
+		return openTSDBTagEmpty
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+
+		return '_'
+	}, s)
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func openTSDBGauge(name string, value float64, labels ...string) *snitch.Measure {
+	return &snitch.Measure{
+		Description: snitch.NewDescription(name, "", snitch.MetricTypeGauge, labels...),
+		CreatedAt:   time.Unix(100, 500000000),
+		Value: &snitch.MeasureValue{
+			Value:       snitch.Float64(value),
+			SampleCount: snitch.Uint64(1),
+		},
+	}
+}
+
+// openTSDBServer returns server collecting points of /api/put requests
+func openTSDBServer(t *testing.T) (*httptest.Server, func() [][]openTSDBPoint) {
+	var (
+		mutex    sync.Mutex
+		requests [][]openTSDBPoint
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/put" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		points := make([]openTSDBPoint, 0)
+
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			t.Error(err)
+		}
+
+		mutex.Lock()
+		requests = append(requests, points)
+		mutex.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	return server, func() [][]openTSDBPoint {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return append([][]openTSDBPoint(nil), requests...)
+	}
+}
+
+func openTSDBTagsString(tags map[string]string) string {
+	return snitch.Labels{}.WithMap(tags).String()
+}
+
+func TestOpenTSDBTagOverflow(t *testing.T) {
+	global := snitch.Labels{{Key: "dc", Value: "eu"}, {Key: "host", Value: "h"}, {Key: "zone", Value: "a"}}
+	labels := []string{"l1", "1", "l2", "2", "l3", "3", "l4", "4", "l5", "5", "l6", "6"}
+
+	tests := []struct {
+		name     string
+		overflow OpenTSDBTagOverflow
+		err      bool
+		expected []string
+	}{
+		{"drop", OpenTSDBTagOverflowDrop, false, []string{
+			"many dc=eu,host=h,l1=1,l2=2,l3=3,l4=4,l5=5,l6=6",
+			"few dc=eu,host=h,room=hall,zone=a",
+		}},
+		{"skip", OpenTSDBTagOverflowSkip, false, []string{
+			"few dc=eu,host=h,room=hall,zone=a",
+		}},
+		{"error", OpenTSDBTagOverflowError, true, nil},
+	}
+
+	for _, test := range tests {
+		server, requests := openTSDBServer(t)
+
+		s, err := NewOpenTSDB(server.URL, WithOpenTSDBMaxTags(DefaultOpenTSDBMaxTags, test.overflow))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.SetLabels(global)
+
+		err = s.Write(snitch.Measures{
+			openTSDBGauge("many", 1, labels...),
+			openTSDBGauge("few", 2, "room", "hall"),
+		})
+		server.Close()
+
+		if test.err {
+			if err == nil || !strings.Contains(err.Error(), ErrOpenTSDBTooManyTags.Error()) {
+				t.Fatalf("%s: expected error of too many tags, got %v", test.name, err)
+			}
+
+			if len(requests()) != 0 {
+				t.Fatalf("%s: points are sent after error", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		result := make([]string, 0)
+
+		for _, request := range requests() {
+			for _, p := range request {
+				result = append(result, p.Metric+" "+openTSDBTagsString(p.Tags))
+			}
+		}
+
+		if strings.Join(result, "|") != strings.Join(test.expected, "|") {
+			t.Fatalf("%s: points %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestOpenTSDBTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		measure  *snitch.Measure
+		global   snitch.Labels
+		expected string
+	}{
+		{
+			"metric wins",
+			openTSDBGauge("temperature", 1, "room", "hall"),
+			snitch.Labels{{Key: "room", Value: "global"}, {Key: "host", Value: "h"}},
+			"host=h,room=hall",
+		},
+		{
+			"sanitized",
+			openTSDBGauge("temperature", 1, "room name", "living room:1", "path", "/api/v1", "empty", ""),
+			nil,
+			"empty=unknown,path=/api/v1,room_name=living_room_1",
+		},
+		{
+			"type fallback",
+			openTSDBGauge("temperature", 1),
+			nil,
+			"type=gauge",
+		},
+	}
+
+	for _, test := range tests {
+		tags, ok := openTSDBTags(test.measure, test.global, DefaultOpenTSDBMaxTags)
+		if !ok {
+			t.Fatalf("%s: tags are overflowed", test.name)
+		}
+
+		if result := openTSDBTagsString(tags); result != test.expected {
+			t.Fatalf("%s: tags %s, expected %s", test.name, result, test.expected)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"http_requests_total": "http_requests_total",
+		"http requests:total": "http_requests_total",
+		"cpu.load/1m-avg":     "cpu.load/1m-avg",
+		"температура":         "температура",
+		"":                    openTSDBTagEmpty,
+	} {
+		if result := sanitizeOpenTSDB(name); result != expected {
+			t.Fatalf("sanitized %q to %q, expected %q", name, result, expected)
+		}
+	}
+}
+
+func TestOpenTSDBBatches(t *testing.T) {
+	server, requests := openTSDBServer(t)
+	defer server.Close()
+
+	s, err := NewOpenTSDB(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measures := make(snitch.Measures, 0, 45)
+
+	for i := 0; i < 45; i++ {
+		measures = append(measures, openTSDBGauge("temperature", float64(i), "sensor", fmt.Sprintf("%02d", i)))
+	}
+
+	if err = s.Write(measures); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := requests()
+	if len(batches) != 3 || len(batches[0]) != DefaultOpenTSDBBatchSize || len(batches[1]) != DefaultOpenTSDBBatchSize || len(batches[2]) != 5 {
+		t.Fatalf("%d batches, expected 20, 20 and 5 points", len(batches))
+	}
+
+	for i, batch := range batches {
+		for j, p := range batch {
+			n := i*DefaultOpenTSDBBatchSize + j
+
+			if p.Metric != "temperature" || p.Value != float64(n) || p.Timestamp != 100500 || p.Tags["sensor"] != fmt.Sprintf("%02d", n) {
+				t.Fatalf("unexpected point %+v at %d", p, n)
+			}
+		}
+	}
+}
+
+func TestOpenTSDBTelnet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	s, err := NewOpenTSDB("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}})
+
+	if err = s.Write(snitch.Measures{
+		openTSDBGauge("temperature", 21.5, "room", "hall"),
+		&snitch.Measure{
+			Description: snitch.NewDescription("latency", "", snitch.MetricTypeHistogram),
+			CreatedAt:   time.Unix(100, 0),
+			Value: &snitch.MeasureValue{
+				SampleCount: snitch.Uint64(2),
+				SampleSum:   snitch.Float64(1.5),
+				Quantiles: map[float64]*float64{
+					0.99: snitch.Float64(1),
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var body string
+
+	select {
+	case body = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("nothing is received")
+	}
+
+	expected := "put temperature 100500 21.5 host=h room=hall\n" +
+		"put latency.count 100000 2 host=h\n" +
+		"put latency.sum 100000 1.5 host=h\n" +
+		"put latency.p99 100000 1 host=h\n"
+
+	if body != expected {
+		t.Fatalf("body:\n%s\nexpected:\n%s", body, expected)
+	}
+}
@@ -0,0 +1,667 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	OTLPEncodingProtobuf OTLPEncoding = iota
+	OTLPEncodingJSON
+
+	DefaultOTLPTimeout = 10 * time.Second
+
+	otlpScopeName = "github.com/kihamo/snitch"
+
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpTemporalityCumulative = 2
+)
+
+type OTLPEncoding int
+
+type OTLPOption func(*OTLP)
+
+// otlpUint64s is encoded to JSON as strings according to OTLP/JSON
+type otlpUint64s []uint64
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	Count             uint64         `json:"count,string"`
+	Sum               *float64       `json:"sum,omitempty"`
+	BucketCounts      otlpUint64s    `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+}
+
+type otlpValueAtQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue        `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64                `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64                `json:"timeUnixNano,string"`
+	Count             uint64                `json:"count,string"`
+	Sum               float64               `json:"sum"`
+	QuantileValues    []otlpValueAtQuantile `json:"quantileValues,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                    `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                       `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+
+	typ snitch.MetricType
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	} `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// OTLP exports measures to OpenTelemetry collector over OTLP/HTTP, global labels
+// are sent as attributes of resource, labels of metrics as attributes of data points
+type OTLP struct {
+	mutex sync.RWMutex
+
+	id       string
+	client   *http.Client
+	url      string
+	encoding OTLPEncoding
+	headers  map[string]string
+	labels   snitch.Labels
+}
+
+func WithOTLPEncoding(encoding OTLPEncoding) OTLPOption {
+	return func(s *OTLP) {
+		s.encoding = encoding
+	}
+}
+
+func WithOTLPHeader(key, value string) OTLPOption {
+	return func(s *OTLP) {
+		s.headers[key] = value
+	}
+}
+
+func WithOTLPTimeout(d time.Duration) OTLPOption {
+	return func(s *OTLP) {
+		if d > 0 {
+			s.client.Timeout = d
+		}
+	}
+}
+
+// NewOTLP creates exporter, url is full address of metrics endpoint
+// such as http://localhost:4318/v1/metrics
+func NewOTLP(url string, opts ...OTLPOption) (*OTLP, error) {
+	return NewOTLPWithID("", url, opts...)
+}
+
+func NewOTLPWithID(id, url string, opts ...OTLPOption) (*OTLP, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &OTLP{
+		id: id,
+		client: &http.Client{
+			Timeout: DefaultOTLPTimeout,
+		},
+		headers: make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := storage.Reinitialization(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *OTLP) ID() string {
+	return s.id
+}
+
+func (s *OTLP) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	endpoint := s.url
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	metrics := otlpMetrics(measures)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var (
+		body        []byte
+		contentType string
+	)
+
+	attributes := otlpAttributes(mergeLabels(nil, globalLabels))
+
+	if s.encoding == OTLPEncodingJSON {
+		scope := &otlpScopeMetrics{
+			Metrics: metrics,
+		}
+		scope.Scope.Name = otlpScopeName
+
+		resource := &otlpResourceMetrics{
+			ScopeMetrics: []*otlpScopeMetrics{scope},
+		}
+		resource.Resource.Attributes = attributes
+
+		data, err := json.Marshal(otlpRequest{
+			ResourceMetrics: []*otlpResourceMetrics{resource},
+		})
+		if err != nil {
+			return err
+		}
+
+		body = data
+		contentType = "application/json"
+	} else {
+		body = encodeOTLPRequest(attributes, metrics)
+		contentType = "application/x-protobuf"
+	}
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", contentType)
+
+	for key, value := range s.headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+
+		return fmt.Errorf("otlp export failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+
+	return nil
+}
+
+func (s *OTLP) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *OTLP) Reinitialization(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported protocol scheme %q of otlp url", u.Scheme)
+	}
+
+	s.mutex.Lock()
+	s.url = addr
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (u otlpUint64s) MarshalJSON() ([]byte, error) {
+	values := make([]string, len(u))
+
+	for i, v := range u {
+		values[i] = strconv.FormatUint(v, 10)
+	}
+
+	return json.Marshal(values)
+}
+
+func otlpAttributes(labels snitch.Labels) []otlpKeyValue {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	attributes := make([]otlpKeyValue, len(labels))
+
+	for i, l := range labels {
+		attributes[i].Key = l.Key
+		attributes[i].Value.StringValue = l.Value
+	}
+
+	return attributes
+}
+
+func otlpTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint64(t.UnixNano())
+}
+
+// otlpMetrics groups measures by name, measures with type different from
+// the first measure of the same name are skipped
+func otlpMetrics(measures snitch.Measures) []*otlpMetric {
+	metrics := make(map[string]*otlpMetric)
+
+	for _, m := range measures {
+		name := m.Description.Name()
+		typ := m.Description.Type()
+
+		metric, ok := metrics[name]
+		if !ok {
+			metric = &otlpMetric{
+				Name:        name,
+				Description: m.Description.Help(),
+				Unit:        m.Description.Unit(),
+				typ:         typ,
+			}
+		} else if metric.typ != typ {
+			continue
+		}
+
+		attributes := otlpAttributes(mergeLabels(nil, m.Description.Labels()))
+		start := otlpTime(m.Description.CreatedAt())
+		now := otlpTime(m.CreatedAt)
+
+		switch typ {
+		case snitch.MetricTypeCounter, snitch.MetricTypeMeter, snitch.MetricTypeGauge, snitch.MetricTypeUntyped:
+			value := *(m.Value.Value)
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			point := &otlpNumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: now,
+				AsDouble:     value,
+			}
+
+			if typ == snitch.MetricTypeCounter || typ == snitch.MetricTypeMeter {
+				if metric.Sum == nil {
+					metric.Sum = &otlpSum{
+						AggregationTemporality: otlpTemporalityCumulative,
+						IsMonotonic:            true,
+					}
+				}
+
+				point.StartTimeUnixNano = start
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+			} else {
+				if metric.Gauge == nil {
+					metric.Gauge = &otlpGauge{}
+				}
+
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point)
+			}
+
+		case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+			if metric.Histogram == nil && metric.Summary == nil {
+				if len(m.Value.Buckets) > 0 {
+					metric.Histogram = &otlpHistogram{
+						AggregationTemporality: otlpTemporalityCumulative,
+					}
+				} else {
+					metric.Summary = &otlpSummary{}
+				}
+			}
+
+			if metric.Histogram != nil {
+				if len(m.Value.Buckets) == 0 {
+					continue
+				}
+
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramPoint(m, attributes, start, now))
+				break
+			}
+
+			point := &otlpSummaryDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Count:             *(m.Value.SampleCount),
+			}
+
+			if sum := *(m.Value.SampleSum); !math.IsNaN(sum) && !math.IsInf(sum, 0) {
+				point.Sum = sum
+			}
+
+			for _, q := range sortedQuantiles(m.Value.Quantiles) {
+				if v := *(m.Value.Quantiles[q]); !math.IsNaN(v) && !math.IsInf(v, 0) {
+					point.QuantileValues = append(point.QuantileValues, otlpValueAtQuantile{
+						Quantile: q,
+						Value:    v,
+					})
+				}
+			}
+
+			metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+
+		default:
+			continue
+		}
+
+		metrics[name] = metric
+	}
+
+	ret := make([]*otlpMetric, 0, len(metrics))
+
+	for _, metric := range metrics {
+		ret = append(ret, metric)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+// otlpHistogramPoint converts cumulative buckets of measure to counts of each bucket
+func otlpHistogramPoint(m *snitch.Measure, attributes []otlpKeyValue, start, now uint64) *otlpHistogramDataPoint {
+	point := &otlpHistogramDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             *(m.Value.SampleCount),
+	}
+
+	finite := func(v *float64) *float64 {
+		if v == nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+			return nil
+		}
+
+		return v
+	}
+
+	point.Sum = finite(m.Value.SampleSum)
+	point.Min = finite(m.Value.SampleMin)
+	point.Max = finite(m.Value.SampleMax)
+
+	var previous uint64
+
+	for _, le := range sortedBuckets(m.Value.Buckets) {
+		count := *(m.Value.Buckets[le])
+
+		if !math.IsInf(le, 1) {
+			point.ExplicitBounds = append(point.ExplicitBounds, le)
+		}
+
+		point.BucketCounts = append(point.BucketCounts, count-previous)
+		previous = count
+	}
+
+	// the last bucket counts values greater than the last bound
+	if len(point.BucketCounts) == len(point.ExplicitBounds) {
+		point.BucketCounts = append(point.BucketCounts, point.Count-previous)
+	}
+
+	return point
+}
+
+// encodeOTLPRequest encodes opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest
+func encodeOTLPRequest(resource []otlpKeyValue, metrics []*otlpMetric) []byte {
+	var scope []byte
+
+	scope = otlpAppendMessage(scope, 1, otlpAppendString(nil, 1, otlpScopeName))
+
+	for _, metric := range metrics {
+		scope = otlpAppendMessage(scope, 2, encodeOTLPMetric(metric))
+	}
+
+	var resourceMetrics, attributes []byte
+
+	for _, kv := range resource {
+		attributes = otlpAppendKeyValue(attributes, 1, kv)
+	}
+
+	resourceMetrics = otlpAppendMessage(resourceMetrics, 1, attributes)
+	resourceMetrics = otlpAppendMessage(resourceMetrics, 2, scope)
+
+	return otlpAppendMessage(nil, 1, resourceMetrics)
+}
+
+func encodeOTLPMetric(metric *otlpMetric) []byte {
+	var b, data []byte
+
+	b = otlpAppendString(b, 1, metric.Name)
+	b = otlpAppendString(b, 2, metric.Description)
+	b = otlpAppendString(b, 3, metric.Unit)
+
+	switch {
+	case metric.Gauge != nil:
+		for _, point := range metric.Gauge.DataPoints {
+			data = otlpAppendMessage(data, 1, encodeOTLPNumberDataPoint(point))
+		}
+
+		b = otlpAppendMessage(b, 5, data)
+
+	case metric.Sum != nil:
+		for _, point := range metric.Sum.DataPoints {
+			data = otlpAppendMessage(data, 1, encodeOTLPNumberDataPoint(point))
+		}
+
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(metric.Sum.AggregationTemporality))
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, protowire.EncodeBool(metric.Sum.IsMonotonic))
+
+		b = otlpAppendMessage(b, 7, data)
+
+	case metric.Histogram != nil:
+		for _, point := range metric.Histogram.DataPoints {
+			data = otlpAppendMessage(data, 1, encodeOTLPHistogramDataPoint(point))
+		}
+
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(metric.Histogram.AggregationTemporality))
+
+		b = otlpAppendMessage(b, 9, data)
+
+	case metric.Summary != nil:
+		for _, point := range metric.Summary.DataPoints {
+			data = otlpAppendMessage(data, 1, encodeOTLPSummaryDataPoint(point))
+		}
+
+		b = otlpAppendMessage(b, 11, data)
+	}
+
+	return b
+}
+
+func encodeOTLPNumberDataPoint(point *otlpNumberDataPoint) []byte {
+	var b []byte
+
+	b = otlpAppendFixed64(b, 2, point.StartTimeUnixNano)
+	b = otlpAppendFixed64(b, 3, point.TimeUnixNano)
+	b = otlpAppendDouble(b, 4, point.AsDouble)
+
+	for _, kv := range point.Attributes {
+		b = otlpAppendKeyValue(b, 7, kv)
+	}
+
+	return b
+}
+
+func encodeOTLPHistogramDataPoint(point *otlpHistogramDataPoint) []byte {
+	var b, packed []byte
+
+	b = otlpAppendFixed64(b, 2, point.StartTimeUnixNano)
+	b = otlpAppendFixed64(b, 3, point.TimeUnixNano)
+	b = otlpAppendFixed64(b, 4, point.Count)
+
+	if point.Sum != nil {
+		b = otlpAppendDouble(b, 5, *point.Sum)
+	}
+
+	for _, count := range point.BucketCounts {
+		packed = protowire.AppendFixed64(packed, count)
+	}
+
+	b = otlpAppendMessage(b, 6, packed)
+	packed = packed[:0]
+
+	for _, bound := range point.ExplicitBounds {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(bound))
+	}
+
+	b = otlpAppendMessage(b, 7, packed)
+
+	for _, kv := range point.Attributes {
+		b = otlpAppendKeyValue(b, 9, kv)
+	}
+
+	if point.Min != nil {
+		b = otlpAppendDouble(b, 11, *point.Min)
+	}
+
+	if point.Max != nil {
+		b = otlpAppendDouble(b, 12, *point.Max)
+	}
+
+	return b
+}
+
+func encodeOTLPSummaryDataPoint(point *otlpSummaryDataPoint) []byte {
+	var b []byte
+
+	b = otlpAppendFixed64(b, 2, point.StartTimeUnixNano)
+	b = otlpAppendFixed64(b, 3, point.TimeUnixNano)
+	b = otlpAppendFixed64(b, 4, point.Count)
+	b = otlpAppendDouble(b, 5, point.Sum)
+
+	for _, q := range point.QuantileValues {
+		var value []byte
+
+		value = otlpAppendDouble(value, 1, q.Quantile)
+		value = otlpAppendDouble(value, 2, q.Value)
+
+		b = otlpAppendMessage(b, 6, value)
+	}
+
+	for _, kv := range point.Attributes {
+		b = otlpAppendKeyValue(b, 7, kv)
+	}
+
+	return b
+}
+
+func otlpAppendKeyValue(b []byte, num protowire.Number, kv otlpKeyValue) []byte {
+	var message []byte
+
+	message = otlpAppendString(message, 1, kv.Key)
+
+	// value is set even if it is empty string
+	value := protowire.AppendTag(nil, 1, protowire.BytesType)
+	value = protowire.AppendString(value, kv.Value.StringValue)
+	message = otlpAppendMessage(message, 2, value)
+
+	return otlpAppendMessage(b, num, message)
+}
+
+func otlpAppendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func otlpAppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func otlpAppendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func otlpAppendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return otlpAppendFixed64(b, num, math.Float64bits(v))
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeOTLPMessage returns raw values of fields of protobuf message,
+// varints are returned encoded, fixed64 values as 8 bytes in little endian
+func decodeOTLPMessage(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+
+		b = b[n:]
+
+		var value []byte
+
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			value, n = b[:8], 8
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				value = b[:n]
+			}
+		}
+
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+
+		fields[num] = append(fields[num], value)
+		b = b[n:]
+	}
+
+	return fields
+}
+
+func otlpServer(body *[]byte, contentType *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*contentType = r.Header.Get("Content-Type")
+		*body, _ = ioutil.ReadAll(r.Body)
+	}))
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	var (
+		body        []byte
+		contentType string
+	)
+
+	server := otlpServer(&body, &contentType)
+	defer server.Close()
+
+	s, err := NewOTLP(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}})
+
+	start := time.Unix(100, 0)
+	now := time.Unix(200, 0)
+
+	if err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescriptionWithCreatedAt("requests_total", "Requests", snitch.MetricTypeCounter, start, "code", "200"),
+			CreatedAt:   now,
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(3),
+				SampleCount: snitch.Uint64(3),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/x-protobuf" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	fixed64 := func(b []byte) uint64 {
+		v, _ := protowire.ConsumeFixed64(b)
+		return v
+	}
+
+	varint := func(b []byte) uint64 {
+		v, _ := protowire.ConsumeVarint(b)
+		return v
+	}
+
+	resourceMetrics := decodeOTLPMessage(t, decodeOTLPMessage(t, body)[1][0])
+
+	attribute := decodeOTLPMessage(t, decodeOTLPMessage(t, resourceMetrics[1][0])[1][0])
+	if string(attribute[1][0]) != "host" || string(decodeOTLPMessage(t, attribute[2][0])[1][0]) != "h" {
+		t.Fatalf("unexpected attribute of resource %q", attribute)
+	}
+
+	scopeMetrics := decodeOTLPMessage(t, resourceMetrics[2][0])
+	if name := string(decodeOTLPMessage(t, scopeMetrics[1][0])[1][0]); name != otlpScopeName {
+		t.Fatalf("unexpected scope %s", name)
+	}
+
+	metric := decodeOTLPMessage(t, scopeMetrics[2][0])
+	if string(metric[1][0]) != "requests_total" || string(metric[2][0]) != "Requests" {
+		t.Fatalf("unexpected metric %q", metric)
+	}
+
+	sum := decodeOTLPMessage(t, metric[7][0])
+	if varint(sum[2][0]) != otlpTemporalityCumulative || varint(sum[3][0]) != 1 {
+		t.Fatalf("sum is not cumulative and monotonic: %q", sum)
+	}
+
+	point := decodeOTLPMessage(t, sum[1][0])
+	if fixed64(point[2][0]) != uint64(start.UnixNano()) || fixed64(point[3][0]) != uint64(now.UnixNano()) {
+		t.Fatalf("unexpected times %d and %d of point", fixed64(point[2][0]), fixed64(point[3][0]))
+	}
+
+	if v := math.Float64frombits(fixed64(point[4][0])); v != 3 {
+		t.Fatalf("unexpected value %v", v)
+	}
+
+	attribute = decodeOTLPMessage(t, point[7][0])
+	if string(attribute[1][0]) != "code" || string(decodeOTLPMessage(t, attribute[2][0])[1][0]) != "200" {
+		t.Fatalf("unexpected attribute of point %q", attribute)
+	}
+}
+
+func TestOTLPJSON(t *testing.T) {
+	var (
+		body        []byte
+		contentType string
+	)
+
+	server := otlpServer(&body, &contentType)
+	defer server.Close()
+
+	s, err := NewOTLP(server.URL, WithOTLPEncoding(OTLPEncodingJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(100, 0)
+
+	if err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescriptionWithCreatedAt("latency_seconds", "", snitch.MetricTypeHistogram, start),
+			CreatedAt:   time.Unix(200, 0),
+			Value: &snitch.MeasureValue{
+				SampleCount: snitch.Uint64(3),
+				SampleSum:   snitch.Float64(1.5),
+				Buckets: map[float64]*uint64{
+					0.1:          snitch.Uint64(1),
+					1:            snitch.Uint64(2),
+					math.Inf(+1): snitch.Uint64(3),
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	var request struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name      string `json:"name"`
+					Unit      string `json:"unit"`
+					Histogram struct {
+						AggregationTemporality int `json:"aggregationTemporality"`
+						DataPoints             []struct {
+							StartTimeUnixNano string    `json:"startTimeUnixNano"`
+							Count             string    `json:"count"`
+							Sum               float64   `json:"sum"`
+							BucketCounts      []string  `json:"bucketCounts"`
+							ExplicitBounds    []float64 `json:"explicitBounds"`
+						} `json:"dataPoints"`
+					} `json:"histogram"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+
+	if err = json.Unmarshal(body, &request); err != nil {
+		t.Fatal(err)
+	}
+
+	metric := request.ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	if metric.Name != "latency_seconds" || metric.Unit != "seconds" || metric.Histogram.AggregationTemporality != otlpTemporalityCumulative {
+		t.Fatalf("unexpected metric %+v", metric)
+	}
+
+	point := metric.Histogram.DataPoints[0]
+	if point.StartTimeUnixNano != "100000000000" || point.Count != "3" || point.Sum != 1.5 {
+		t.Fatalf("unexpected point %+v", point)
+	}
+
+	if len(point.ExplicitBounds) != 2 || point.ExplicitBounds[0] != 0.1 || point.ExplicitBounds[1] != 1 {
+		t.Fatalf("unexpected bounds %v", point.ExplicitBounds)
+	}
+
+	if len(point.BucketCounts) != 3 || point.BucketCounts[0] != "1" || point.BucketCounts[1] != "1" || point.BucketCounts[2] != "1" {
+		t.Fatalf("unexpected bucket counts %v", point.BucketCounts)
+	}
+}
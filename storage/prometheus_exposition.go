@@ -1,8 +1,333 @@
 package storage
 
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	prometheusHelpReplacer       = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	prometheusLabelValueReplacer = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+type prometheusFamily struct {
+	name        string
+	description *snitch.Description
+	series      []*prometheusSeries
+}
+
+type prometheusSeries struct {
+	labels    snitch.Labels
+	value     *snitch.MeasureValue
+	createdAt time.Time
+	timestamp time.Time
+}
+
 type PrometheusExposition struct {
+	mutex sync.RWMutex
+
+	id       string
+	callback func() (snitch.Measures, error)
+	labels   snitch.Labels
+	measures snitch.Measures
 }
 
 func NewPrometheusExposition() *PrometheusExposition {
-	return &PrometheusExposition{}
+	return NewPrometheusExpositionWithID("")
+}
+
+func NewPrometheusExpositionWithID(id string) *PrometheusExposition {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	return &PrometheusExposition{
+		id: id,
+	}
+}
+
+func (s *PrometheusExposition) ID() string {
+	return s.id
+}
+
+func (s *PrometheusExposition) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.measures = measures
+
+	return nil
+}
+
+func (s *PrometheusExposition) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *PrometheusExposition) SetCallback(f func() (snitch.Measures, error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.callback = f
+}
+
+func (s *PrometheusExposition) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	measures, labels := s.snapshot()
+
+	var (
+		b           bytes.Buffer
+		err         error
+		contentType string
+	)
+
+	if acceptOpenMetrics(r.Header.Get("Accept")) {
+		contentType = OpenMetricsContentType
+		err = writeOpenMetricsText(&b, measures, labels)
+	} else {
+		contentType = PrometheusContentType
+		err = writePrometheusText(&b, measures, labels)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b.Bytes())
+}
+
+func (s *PrometheusExposition) snapshot() (snitch.Measures, snitch.Labels) {
+	s.mutex.RLock()
+	callback := s.callback
+	s.mutex.RUnlock()
+
+	if callback != nil {
+		if measures, _ := callback(); measures != nil {
+			s.Write(measures)
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.measures, s.labels
+}
+
+func writePrometheusText(w io.Writer, measures snitch.Measures, labels snitch.Labels) error {
+	var b strings.Builder
+
+	for _, family := range prometheusFamilies(measures, labels) {
+		if help := family.description.Help(); help != "" {
+			b.WriteString("# HELP " + family.name + " " + prometheusHelpReplacer.Replace(help) + "\n")
+		}
+
+		switch family.description.Type() {
+		case snitch.MetricTypeCounter, snitch.MetricTypeMeter:
+			b.WriteString("# TYPE " + family.name + " counter\n")
+
+			for _, series := range family.series {
+				writePrometheusSample(&b, family.name, series.labels, *(series.value.Value))
+			}
+
+		case snitch.MetricTypeGauge:
+			b.WriteString("# TYPE " + family.name + " gauge\n")
+
+			for _, series := range family.series {
+				writePrometheusSample(&b, family.name, series.labels, *(series.value.Value))
+			}
+
+		case snitch.MetricTypeUntyped:
+			b.WriteString("# TYPE " + family.name + " untyped\n")
+
+			for _, series := range family.series {
+				writePrometheusSample(&b, family.name, series.labels, *(series.value.Value))
+			}
+
+		case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+			if family.bucketed() {
+				b.WriteString("# TYPE " + family.name + " histogram\n")
+			} else {
+				b.WriteString("# TYPE " + family.name + " summary\n")
+			}
+
+			for _, series := range family.series {
+				writePrometheusDistribution(&b, family.name, series)
+
+				sum := *(series.value.SampleSum)
+				if math.IsNaN(sum) {
+					sum = 0
+				}
+
+				writePrometheusSample(&b, family.name+"_sum", series.labels, sum)
+				writePrometheusSample(&b, family.name+"_count", series.labels, float64(*(series.value.SampleCount)))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func writePrometheusDistribution(b *strings.Builder, name string, series *prometheusSeries) {
+	if len(series.value.Buckets) > 0 {
+		for _, le := range sortedBuckets(series.value.Buckets) {
+			writePrometheusSample(b, name+"_bucket", series.labels.With("le", formatBucketBound(le)), float64(*(series.value.Buckets[le])))
+		}
+
+		return
+	}
+
+	for _, q := range sortedQuantiles(series.value.Quantiles) {
+		writePrometheusSample(b, name, series.labels.With("quantile", formatPrometheusFloat(q)), *(series.value.Quantiles[q]))
+	}
+}
+
+func writePrometheusSample(b *strings.Builder, name string, labels snitch.Labels, value float64) {
+	b.WriteString(name)
+
+	if len(labels) > 0 {
+		b.WriteString("{")
+
+		for i, l := range labels {
+			if i != 0 {
+				b.WriteString(",")
+			}
+
+			b.WriteString(prometheusLabelName(l.Key) + "=\"" + prometheusLabelValueReplacer.Replace(l.Value) + "\"")
+		}
+
+		b.WriteString("}")
+	}
+
+	b.WriteString(" " + formatPrometheusFloat(value) + "\n")
+}
+
+func (f *prometheusFamily) bucketed() bool {
+	return len(f.series) > 0 && len(f.series[0].value.Buckets) > 0
+}
+
+func prometheusFamilies(measures snitch.Measures, labels snitch.Labels) []*prometheusFamily {
+	families := make(map[string]*prometheusFamily)
+
+	for _, m := range measures {
+		switch m.Description.Type() {
+		case snitch.MetricTypeUntyped, snitch.MetricTypeCounter, snitch.MetricTypeGauge, snitch.MetricTypeHistogram, snitch.MetricTypeTimer, snitch.MetricTypeMeter:
+		default:
+			continue
+		}
+
+		name := prometheusMetricName(m.Description.Name())
+
+		family, ok := families[name]
+		if !ok {
+			family = &prometheusFamily{
+				name:        name,
+				description: m.Description,
+			}
+			families[name] = family
+		} else if family.description.Type() != m.Description.Type() {
+			continue
+		}
+
+		family.series = append(family.series, &prometheusSeries{
+			labels:    mergeLabels(labels, m.Description.Labels()),
+			value:     m.Value,
+			createdAt: m.Description.CreatedAt(),
+			timestamp: m.CreatedAt,
+		})
+	}
+
+	ret := make([]*prometheusFamily, 0, len(families))
+
+	for _, family := range families {
+		sort.Slice(family.series, func(i, j int) bool {
+			return family.series[i].labels.String() < family.series[j].labels.String()
+		})
+
+		ret = append(ret, family)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+
+	return ret
+}
+
+func sortedQuantiles(quantiles map[float64]*float64) []float64 {
+	ret := make([]float64, 0, len(quantiles))
+
+	for q := range quantiles {
+		ret = append(ret, q)
+	}
+
+	sort.Float64s(ret)
+
+	return ret
+}
+
+func prometheusMetricName(name string) string {
+	return sanitizePrometheusName(name, true)
+}
+
+func prometheusLabelName(name string) string {
+	return sanitizePrometheusName(name, false)
+}
+
+func sanitizePrometheusName(name string, colon bool) string {
+	if name == "" {
+		return "_"
+	}
+
+	var b strings.Builder
+
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', colon && r == ':':
+			b.WriteRune(r)
+
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+
+			b.WriteRune(r)
+
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
+
+func formatPrometheusFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
 }
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func expositionMeasures() snitch.Measures {
+	createdAt := time.Unix(100, 500000000)
+
+	return snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescriptionWithCreatedAt("requests_total", "Requests\nserved", snitch.MetricTypeCounter, createdAt, "code", "200"),
+			CreatedAt:   time.Unix(200, 0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(3),
+				SampleCount: snitch.Uint64(3),
+			},
+		},
+		&snitch.Measure{
+			Description: snitch.NewDescriptionWithCreatedAt("temperature_celsius", "", snitch.MetricTypeGauge, createdAt, "room", `"hall"`),
+			CreatedAt:   time.Unix(200, 0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(21.5),
+				SampleCount: snitch.Uint64(1),
+			},
+		},
+		&snitch.Measure{
+			Description: snitch.NewDescriptionWithCreatedAt("latency_seconds", "Latency", snitch.MetricTypeHistogram, createdAt),
+			CreatedAt:   time.Unix(200, 0),
+			Value: &snitch.MeasureValue{
+				SampleCount: snitch.Uint64(2),
+				SampleSum:   snitch.Float64(1.5),
+				Quantiles: map[float64]*float64{
+					0.5: snitch.Float64(0.5),
+					0.9: snitch.Float64(1),
+				},
+			},
+		},
+	}
+}
+
+func serveExposition(t *testing.T, accept string) (string, string) {
+	s := NewPrometheusExposition()
+	s.SetLabels(snitch.Labels{{Key: "host", Value: "h"}})
+
+	if err := s.Write(expositionMeasures()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+
+	return response.Header().Get("Content-Type"), response.Body.String()
+}
+
+func TestPrometheusExpositionText(t *testing.T) {
+	contentType, body := serveExposition(t, "text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+
+	if contentType != PrometheusContentType {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	expected := `# HELP latency_seconds Latency
+# TYPE latency_seconds summary
+latency_seconds{host="h",quantile="0.5"} 0.5
+latency_seconds{host="h",quantile="0.9"} 1
+latency_seconds_sum{host="h"} 1.5
+latency_seconds_count{host="h"} 2
+# HELP requests_total Requests\nserved
+# TYPE requests_total counter
+requests_total{code="200",host="h"} 3
+# TYPE temperature_celsius gauge
+temperature_celsius{host="h",room="\"hall\""} 21.5
+`
+
+	if body != expected {
+		t.Fatalf("body:\n%s\nexpected:\n%s", body, expected)
+	}
+}
@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	DefaultPrometheusRemoteWriteTimeout    = 30 * time.Second
+	DefaultPrometheusRemoteWriteRetries    = 3
+	DefaultPrometheusRemoteWriteMinBackoff = 30 * time.Millisecond
+	DefaultPrometheusRemoteWriteMaxBackoff = 5 * time.Second
+
+	prometheusRemoteWriteVersion = "0.1.0"
+
+	// types of metric metadata from prometheus.MetricMetadata.MetricType
+	prometheusRemoteTypeUnknown   = 0
+	prometheusRemoteTypeCounter   = 1
+	prometheusRemoteTypeGauge     = 2
+	prometheusRemoteTypeHistogram = 3
+	prometheusRemoteTypeSummary   = 5
+)
+
+type PrometheusRemoteWriteOption func(*PrometheusRemoteWrite)
+
+type prometheusRemoteSample struct {
+	labels    snitch.Labels
+	value     float64
+	timestamp int64
+}
+
+type prometheusRemoteMetadata struct {
+	typ  uint64
+	name string
+	help string
+	unit string
+}
+
+// PrometheusRemoteWrite pushes measures to receivers of Prometheus remote write protocol
+// such as Cortex, Mimir, Thanos or VictoriaMetrics. Histograms and timers without buckets
+// are sent as summaries. Requests failed with 5xx or 429 status are retried with backoff
+type PrometheusRemoteWrite struct {
+	mutex sync.RWMutex
+
+	id         string
+	client     *http.Client
+	url        string
+	headers    map[string]string
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	labels     snitch.Labels
+}
+
+func WithPrometheusRemoteWriteHeader(key, value string) PrometheusRemoteWriteOption {
+	return func(s *PrometheusRemoteWrite) {
+		s.headers[key] = value
+	}
+}
+
+func WithPrometheusRemoteWriteTimeout(d time.Duration) PrometheusRemoteWriteOption {
+	return func(s *PrometheusRemoteWrite) {
+		if d > 0 {
+			s.client.Timeout = d
+		}
+	}
+}
+
+func WithPrometheusRemoteWriteRetries(retries int, min, max time.Duration) PrometheusRemoteWriteOption {
+	return func(s *PrometheusRemoteWrite) {
+		if retries >= 0 {
+			s.retries = retries
+		}
+
+		if min > 0 {
+			s.minBackoff = min
+		}
+
+		if max >= s.minBackoff {
+			s.maxBackoff = max
+		}
+	}
+}
+
+func NewPrometheusRemoteWrite(url string, opts ...PrometheusRemoteWriteOption) (*PrometheusRemoteWrite, error) {
+	return NewPrometheusRemoteWriteWithID("", url, opts...)
+}
+
+func NewPrometheusRemoteWriteWithID(id, url string, opts ...PrometheusRemoteWriteOption) (*PrometheusRemoteWrite, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &PrometheusRemoteWrite{
+		id: id,
+		client: &http.Client{
+			Timeout: DefaultPrometheusRemoteWriteTimeout,
+		},
+		headers:    make(map[string]string),
+		retries:    DefaultPrometheusRemoteWriteRetries,
+		minBackoff: DefaultPrometheusRemoteWriteMinBackoff,
+		maxBackoff: DefaultPrometheusRemoteWriteMaxBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := storage.Reinitialization(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *PrometheusRemoteWrite) ID() string {
+	return s.id
+}
+
+func (s *PrometheusRemoteWrite) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	endpoint := s.url
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	samples, metadata := prometheusRemoteSamples(measures, globalLabels)
+	if len(samples) == 0 {
+		return nil
+	}
+
+	body := snappy.Encode(nil, encodePrometheusWriteRequest(samples, metadata))
+
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := s.post(endpoint, body)
+		if err == nil || !retry || attempt >= s.retries {
+			return err
+		}
+
+		if wait <= 0 {
+			wait = s.backoff(attempt)
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+func (s *PrometheusRemoteWrite) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *PrometheusRemoteWrite) Reinitialization(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported protocol scheme %q of remote write url", u.Scheme)
+	}
+
+	s.mutex.Lock()
+	s.url = addr
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// post returns flag that the request can be retried and delay requested by the receiver
+func (s *PrometheusRemoteWrite) post(endpoint string, body []byte) (bool, time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", prometheusRemoteWriteVersion)
+
+	for key, value := range s.headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return true, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, response.Body)
+		return false, 0, nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	err = fmt.Errorf("remote write failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		return true, s.retryAfter(response.Header.Get("Retry-After")), err
+	}
+
+	return response.StatusCode/100 == 5, 0, err
+}
+
+// retryAfter parses Retry-After header in seconds or HTTP-date form,
+// the wait is limited by the max backoff so server can't stall writes
+func (s *PrometheusRemoteWrite) retryAfter(value string) time.Duration {
+	var wait time.Duration
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds > int64(s.maxBackoff/time.Second) {
+			return s.maxBackoff
+		}
+
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		wait = time.Until(t)
+	}
+
+	if wait > s.maxBackoff {
+		wait = s.maxBackoff
+	}
+
+	return wait
+}
+
+func (s *PrometheusRemoteWrite) backoff(attempt int) time.Duration {
+	d := s.minBackoff
+
+	for i := 0; i < attempt && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+
+	return d
+}
+
+func prometheusRemoteSamples(measures snitch.Measures, labels snitch.Labels) ([]prometheusRemoteSample, []prometheusRemoteMetadata) {
+	families := prometheusFamilies(measures, labels)
+
+	samples := make([]prometheusRemoteSample, 0, len(measures))
+	metadata := make([]prometheusRemoteMetadata, 0, len(families))
+
+	for _, family := range families {
+		meta := prometheusRemoteMetadata{
+			name: family.name,
+			help: family.description.Help(),
+			unit: family.description.Unit(),
+		}
+
+		add := func(name string, series *prometheusSeries, value float64, extra ...string) {
+			// labels of series are copied because samples keep them until encoding
+			labels := make(snitch.Labels, 0, len(series.labels)+2)
+			labels = append(labels, series.labels...)
+
+			samples = append(samples, prometheusRemoteSample{
+				labels:    labels.With(append(extra, "__name__", name)...),
+				value:     value,
+				timestamp: series.timestamp.UnixNano() / int64(time.Millisecond),
+			})
+		}
+
+		switch family.description.Type() {
+		case snitch.MetricTypeCounter, snitch.MetricTypeMeter, snitch.MetricTypeGauge, snitch.MetricTypeUntyped:
+			switch family.description.Type() {
+			case snitch.MetricTypeGauge:
+				meta.typ = prometheusRemoteTypeGauge
+			case snitch.MetricTypeUntyped:
+				meta.typ = prometheusRemoteTypeUnknown
+			default:
+				meta.typ = prometheusRemoteTypeCounter
+			}
+
+			for _, series := range family.series {
+				add(family.name, series, *(series.value.Value))
+			}
+
+		case snitch.MetricTypeHistogram, snitch.MetricTypeTimer:
+			meta.typ = prometheusRemoteTypeSummary
+			if family.bucketed() {
+				meta.typ = prometheusRemoteTypeHistogram
+			}
+
+			for _, series := range family.series {
+				if len(series.value.Buckets) > 0 {
+					for _, le := range sortedBuckets(series.value.Buckets) {
+						add(family.name+"_bucket", series, float64(*(series.value.Buckets[le])), "le", formatBucketBound(le))
+					}
+				} else {
+					for _, q := range sortedQuantiles(series.value.Quantiles) {
+						add(family.name, series, *(series.value.Quantiles[q]), "quantile", formatPrometheusFloat(q))
+					}
+				}
+
+				sum := *(series.value.SampleSum)
+				if math.IsNaN(sum) {
+					sum = 0
+				}
+
+				add(family.name+"_sum", series, sum)
+				add(family.name+"_count", series, float64(*(series.value.SampleCount)))
+			}
+		}
+
+		metadata = append(metadata, meta)
+	}
+
+	return samples, metadata
+}
+
+// encodePrometheusWriteRequest encodes prometheus.WriteRequest message,
+// every sample is sent as separate time series with sorted labels
+func encodePrometheusWriteRequest(samples []prometheusRemoteSample, metadata []prometheusRemoteMetadata) []byte {
+	var (
+		request []byte
+		series  []byte
+		message []byte
+	)
+
+	for _, sample := range samples {
+		labels := make(snitch.Labels, 0, len(sample.labels))
+		for _, l := range sample.labels {
+			if l.Key != "__name__" {
+				l = &snitch.Label{Key: prometheusLabelName(l.Key), Value: l.Value}
+			}
+
+			labels = append(labels, l)
+		}
+
+		sort.SliceStable(labels, func(i, j int) bool {
+			return labels[i].Key < labels[j].Key
+		})
+
+		series = series[:0]
+
+		for _, l := range labels {
+			message = message[:0]
+			message = protowire.AppendTag(message, 1, protowire.BytesType)
+			message = protowire.AppendString(message, l.Key)
+			message = protowire.AppendTag(message, 2, protowire.BytesType)
+			message = protowire.AppendString(message, l.Value)
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, message)
+		}
+
+		message = message[:0]
+		message = protowire.AppendTag(message, 1, protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, math.Float64bits(sample.value))
+		message = protowire.AppendTag(message, 2, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(sample.timestamp))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, message)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+
+	for _, meta := range metadata {
+		message = message[:0]
+		message = protowire.AppendTag(message, 1, protowire.VarintType)
+		message = protowire.AppendVarint(message, meta.typ)
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendString(message, meta.name)
+
+		if meta.help != "" {
+			message = protowire.AppendTag(message, 4, protowire.BytesType)
+			message = protowire.AppendString(message, meta.help)
+		}
+
+		if meta.unit != "" {
+			message = protowire.AppendTag(message, 5, protowire.BytesType)
+			message = protowire.AppendString(message, meta.unit)
+		}
+
+		request = protowire.AppendTag(request, 3, protowire.BytesType)
+		request = protowire.AppendBytes(request, message)
+	}
+
+	return request
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kihamo/snitch"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodePrometheusWriteRequest returns samples of WriteRequest by series written as name{key="value",...}
+func decodePrometheusWriteRequest(t *testing.T, b []byte) map[string]float64 {
+	samples := make(map[string]float64)
+
+	each := func(b []byte, f func(protowire.Number, protowire.Type, []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+
+			b = b[n:]
+
+			if n = f(num, typ, b); n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+
+			b = b[n:]
+		}
+	}
+
+	each(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 {
+			return protowire.ConsumeFieldValue(num, typ, b)
+		}
+
+		series, n := protowire.ConsumeBytes(b)
+
+		var (
+			name   string
+			labels []string
+			values []float64
+		)
+
+		each(series, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			message, n := protowire.ConsumeBytes(b)
+
+			switch num {
+			case 1:
+				var key, value string
+
+				each(message, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					v, n := protowire.ConsumeBytes(b)
+
+					if num == 1 {
+						key = string(v)
+					} else {
+						value = string(v)
+					}
+
+					return n
+				})
+
+				if key == "__name__" {
+					name = value
+				} else {
+					labels = append(labels, key+"=\""+value+"\"")
+				}
+
+			case 2:
+				each(message, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						v, n := protowire.ConsumeFixed64(b)
+						values = append(values, math.Float64frombits(v))
+
+						return n
+					}
+
+					return protowire.ConsumeFieldValue(num, typ, b)
+				})
+			}
+
+			return n
+		})
+
+		for _, v := range values {
+			samples[name+"{"+strings.Join(labels, ",")+"}"] = v
+		}
+
+		return n
+	})
+
+	return samples
+}
+
+func TestPrometheusRemoteWriteBody(t *testing.T) {
+	var (
+		body    []byte
+		headers http.Header
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s, err := NewPrometheusRemoteWrite(server.URL, WithPrometheusRemoteWriteHeader("X-Scope-OrgID", "tenant"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLabels(snitch.Labels{{Key: "zone", Value: "a"}})
+
+	counter := snitch.NewCounter("requests_total", "Requests", "code", "200")
+	counter.Add(3)
+
+	value, _ := counter.Measure()
+
+	if err = s.Write(snitch.Measures{
+		&snitch.Measure{
+			Description: counter.Description(),
+			CreatedAt:   time.Now(),
+			Value:       value,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if headers.Get("Content-Encoding") != "snappy" || headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected headers %v", headers)
+	}
+
+	if headers.Get("X-Scope-OrgID") != "tenant" {
+		t.Fatalf("custom header is not sent: %v", headers)
+	}
+
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := decodePrometheusWriteRequest(t, decoded)
+
+	if v, ok := samples[`requests_total{code="200",zone="a"}`]; !ok || v != 3 {
+		t.Fatalf("unexpected samples %v", samples)
+	}
+}
+
+func TestPrometheusRemoteWriteRetries(t *testing.T) {
+	gauge := snitch.NewGauge("temperature_celsius", "")
+	gauge.Set(21.5)
+
+	value, _ := gauge.Measure()
+	measures := snitch.Measures{
+		&snitch.Measure{
+			Description: gauge.Description(),
+			CreatedAt:   time.Now(),
+			Value:       value,
+		},
+	}
+
+	for _, c := range []struct {
+		status int
+		calls  int32
+	}{
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusBadRequest, 1},
+	} {
+		var calls int32
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(c.status)
+		}))
+
+		s, err := NewPrometheusRemoteWrite(server.URL, WithPrometheusRemoteWriteRetries(2, time.Millisecond, 10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = s.Write(measures); err == nil {
+			t.Fatalf("status %d: expected error", c.status)
+		}
+
+		if n := atomic.LoadInt32(&calls); n != c.calls {
+			t.Fatalf("status %d: %d calls, expected %d", c.status, n, c.calls)
+		}
+
+		server.Close()
+	}
+}
+
+func TestPrometheusRemoteWriteRetryAfter(t *testing.T) {
+	s, err := NewPrometheusRemoteWrite("http://localhost", WithPrometheusRemoteWriteRetries(1, time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for value, expected := range map[string]time.Duration{
+		"":                  0,
+		"invalid":           0,
+		"0":                 0,
+		"1":                 time.Second,
+		"3600":              time.Second,
+		"99999999999999999": time.Second,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat):  time.Second,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	} {
+		if wait := s.retryAfter(value); wait > expected || (expected > 0 && wait <= 0) {
+			t.Fatalf("Retry-After %q: wait %s, expected %s", value, wait, expected)
+		}
+	}
+}
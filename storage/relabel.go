@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+const (
+	RelabelNameLabel = "__name__"
+)
+
+// RelabelRule changes name and labels of measure, false means that measure must be dropped
+type RelabelRule func(name string, labels snitch.Labels) (string, snitch.Labels, bool)
+
+// Relabel filters and relabels measures before write to the wrapped storage.
+// Rules are applied to metric labels only, global labels are passed as is
+type Relabel struct {
+	storage snitch.Storage
+	rules   []RelabelRule
+}
+
+func NewRelabel(s snitch.Storage, rules ...RelabelRule) *Relabel {
+	return &Relabel{
+		storage: s,
+		rules:   rules,
+	}
+}
+
+func (s *Relabel) ID() string {
+	return s.storage.ID()
+}
+
+func (s *Relabel) Write(measures snitch.Measures) error {
+	return s.storage.Write(s.apply(measures))
+}
+
+func (s *Relabel) SetLabels(l snitch.Labels) {
+	s.storage.SetLabels(l)
+}
+
+func (s *Relabel) SetCallback(f func() (snitch.Measures, error)) {
+	rs, ok := s.storage.(snitch.StorageRealtime)
+	if !ok {
+		return
+	}
+
+	if f == nil {
+		rs.SetCallback(nil)
+		return
+	}
+
+	rs.SetCallback(func() (snitch.Measures, error) {
+		measures, err := f()
+		return s.apply(measures), err
+	})
+}
+
+func (s *Relabel) SendInterval() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendInterval()
+	}
+
+	return 0
+}
+
+func (s *Relabel) SendJitter() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendJitter()
+	}
+
+	return 0
+}
+
+func (s *Relabel) apply(measures snitch.Measures) snitch.Measures {
+	if len(s.rules) == 0 || len(measures) == 0 {
+		return measures
+	}
+
+	ret := make(snitch.Measures, 0, len(measures))
+
+	for _, m := range measures {
+		name := m.Description.Name()
+		labels := append(snitch.Labels(nil), m.Description.Labels()...)
+		keep := true
+
+		for _, rule := range s.rules {
+			if name, labels, keep = rule(name, labels); !keep {
+				break
+			}
+		}
+
+		if !keep {
+			continue
+		}
+
+		if name == m.Description.Name() && labelsEqual(labels, m.Description.Labels()) {
+			ret = append(ret, m)
+			continue
+		}
+
+		ret = append(ret, &snitch.Measure{
+			Description: m.Description.Relabel(name, labels),
+			CreatedAt:   m.CreatedAt,
+			Value:       m.Value,
+		})
+	}
+
+	return ret
+}
+
+func AllowNames(patterns ...string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, matchGlob(name, patterns)
+	}
+}
+
+func DenyNames(patterns ...string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, !matchGlob(name, patterns)
+	}
+}
+
+func AllowNamesRegexp(re *regexp.Regexp) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, re.MatchString(name)
+	}
+}
+
+func DenyNamesRegexp(re *regexp.Regexp) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, !re.MatchString(name)
+	}
+}
+
+func KeepLabels(keys ...string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		ret := labels[:0]
+
+		for _, l := range labels {
+			if containsString(keys, l.Key) {
+				ret = append(ret, l)
+			}
+		}
+
+		return name, ret, true
+	}
+}
+
+func DropLabels(keys ...string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		ret := labels[:0]
+
+		for _, l := range labels {
+			if !containsString(keys, l.Key) {
+				ret = append(ret, l)
+			}
+		}
+
+		return name, ret, true
+	}
+}
+
+func RenameLabel(from, to string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		for i, l := range labels {
+			if l.Key == from {
+				labels[i] = &snitch.Label{Key: to, Value: l.Value}
+			}
+		}
+
+		return name, labels, true
+	}
+}
+
+// KeepIfMatch keeps only measures with joined values of source labels matching the regex
+func KeepIfMatch(sourceLabels []string, separator string, re *regexp.Regexp) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, re.MatchString(relabelSourceValue(name, labels, sourceLabels, separator))
+	}
+}
+
+// DropIfMatch drops measures with joined values of source labels matching the regex
+func DropIfMatch(sourceLabels []string, separator string, re *regexp.Regexp) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		return name, labels, !re.MatchString(relabelSourceValue(name, labels, sourceLabels, separator))
+	}
+}
+
+// Replace works like replace action of Prometheus relabel_configs: joined values of source labels
+// are matched against the regex and the target label is set to expanded replacement, the target
+// __name__ changes name of metric and the empty value removes the target label
+func Replace(sourceLabels []string, separator string, re *regexp.Regexp, target, replacement string) RelabelRule {
+	return func(name string, labels snitch.Labels) (string, snitch.Labels, bool) {
+		value := relabelSourceValue(name, labels, sourceLabels, separator)
+
+		match := re.FindStringSubmatchIndex(value)
+		if match == nil {
+			return name, labels, true
+		}
+
+		result := string(re.ExpandString(nil, replacement, value, match))
+
+		if target == RelabelNameLabel {
+			if result != "" {
+				name = result
+			}
+
+			return name, labels, true
+		}
+
+		ret := labels[:0]
+
+		for _, l := range labels {
+			if l.Key != target {
+				ret = append(ret, l)
+			}
+		}
+
+		if result != "" {
+			ret = append(ret, &snitch.Label{Key: target, Value: result})
+		}
+
+		return name, ret, true
+	}
+}
+
+func relabelSourceValue(name string, labels snitch.Labels, sourceLabels []string, separator string) string {
+	values := make([]string, 0, len(sourceLabels))
+
+	for _, key := range sourceLabels {
+		if key == RelabelNameLabel {
+			values = append(values, name)
+			continue
+		}
+
+		var value string
+
+		for _, l := range labels {
+			if l.Key == key {
+				value = l.Value
+			}
+		}
+
+		values = append(values, value)
+	}
+
+	return strings.Join(values, separator)
+}
+
+func matchGlob(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func labelsEqual(a, b snitch.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+
+	return true
+}
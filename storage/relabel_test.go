@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func relabelMeasure(name string, labels ...string) *snitch.Measure {
+	return &snitch.Measure{
+		Description: snitch.NewDescription(name, "", snitch.MetricTypeGauge, labels...),
+		CreatedAt:   time.Unix(100, 0),
+		Value: &snitch.MeasureValue{
+			Value:       snitch.Float64(1),
+			SampleCount: snitch.Uint64(1),
+		},
+	}
+}
+
+// relabelResult formats measures keeping the stored order of labels
+func relabelResult(measures snitch.Measures) string {
+	ret := make([]string, 0, len(measures))
+
+	for _, m := range measures {
+		labels := make([]string, 0, len(m.Description.Labels()))
+
+		for _, l := range m.Description.Labels() {
+			labels = append(labels, l.String())
+		}
+
+		ret = append(ret, m.Description.Name()+"{"+strings.Join(labels, ",")+"}")
+	}
+
+	return strings.Join(ret, " ")
+}
+
+func TestRelabelRules(t *testing.T) {
+	input := func() snitch.Measures {
+		return snitch.Measures{
+			relabelMeasure("http_requests_total", "path", "/api", "code", "200"),
+			relabelMeasure("http_latency_seconds", "path", "/", "code", "500"),
+			relabelMeasure("go_goroutines"),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rules    []RelabelRule
+		expected string
+	}{
+		{
+			"no rules",
+			nil,
+			"http_requests_total{path=/api,code=200} http_latency_seconds{path=/,code=500} go_goroutines{}",
+		},
+		{
+			"allow glob",
+			[]RelabelRule{AllowNames("http_*", "process_*")},
+			"http_requests_total{path=/api,code=200} http_latency_seconds{path=/,code=500}",
+		},
+		{
+			"deny glob",
+			[]RelabelRule{DenyNames("http_*")},
+			"go_goroutines{}",
+		},
+		{
+			"allow regexp",
+			[]RelabelRule{AllowNamesRegexp(regexp.MustCompile(`_total$`))},
+			"http_requests_total{path=/api,code=200}",
+		},
+		{
+			"deny regexp",
+			[]RelabelRule{DenyNamesRegexp(regexp.MustCompile(`^go_`))},
+			"http_requests_total{path=/api,code=200} http_latency_seconds{path=/,code=500}",
+		},
+		{
+			"keep labels",
+			[]RelabelRule{DenyNames("go_*"), KeepLabels("code")},
+			"http_requests_total{code=200} http_latency_seconds{code=500}",
+		},
+		{
+			"drop labels",
+			[]RelabelRule{DenyNames("go_*"), DropLabels("code")},
+			"http_requests_total{path=/api} http_latency_seconds{path=/}",
+		},
+		{
+			"rename label",
+			[]RelabelRule{DenyNames("go_*"), RenameLabel("path", "handler")},
+			"http_requests_total{code=200,handler=/api} http_latency_seconds{code=500,handler=/}",
+		},
+		{
+			"replace label",
+			[]RelabelRule{
+				AllowNames("http_requests_total"),
+				Replace([]string{"code"}, "", regexp.MustCompile(`^(\d)\d\d$`), "class", "${1}xx"),
+			},
+			"http_requests_total{class=2xx,code=200,path=/api}",
+		},
+		{
+			"replace removes label",
+			[]RelabelRule{
+				AllowNames("http_requests_total"),
+				Replace([]string{"path"}, "", regexp.MustCompile(`.*`), "path", ""),
+			},
+			"http_requests_total{code=200}",
+		},
+		{
+			"replace name",
+			[]RelabelRule{
+				AllowNames("http_*"),
+				Replace([]string{RelabelNameLabel, "code"}, ";", regexp.MustCompile(`^http_(.+);5\d\d$`), RelabelNameLabel, "failed_$1"),
+			},
+			"http_requests_total{path=/api,code=200} failed_latency_seconds{code=500,path=/}",
+		},
+		{
+			"keep if match",
+			[]RelabelRule{KeepIfMatch([]string{"path", "code"}, ":", regexp.MustCompile(`^/api:`))},
+			"http_requests_total{path=/api,code=200}",
+		},
+		{
+			"drop if match",
+			[]RelabelRule{DropIfMatch([]string{"code"}, "", regexp.MustCompile(`^5`))},
+			"http_requests_total{path=/api,code=200} go_goroutines{}",
+		},
+	}
+
+	for _, test := range tests {
+		inner := &testStorage{id: "influx"}
+
+		if err := NewRelabel(inner, test.rules...).Write(input()); err != nil {
+			t.Fatal(err)
+		}
+
+		batches := inner.Batches()
+		if len(batches) != 1 {
+			t.Fatalf("%s: %d batches written", test.name, len(batches))
+		}
+
+		if result := relabelResult(batches[0]); result != test.expected {
+			t.Fatalf("%s: result %s, expected %s", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestRelabelKeepsSource(t *testing.T) {
+	measure := relabelMeasure("http_requests_total", "path", "/api", "code", "200")
+	inner := &testStorage{id: "influx"}
+
+	if err := NewRelabel(inner, DropLabels("path")).Write(snitch.Measures{measure}); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := relabelResult(snitch.Measures{measure}); result != "http_requests_total{path=/api,code=200}" {
+		t.Fatalf("source measure is changed to %s", result)
+	}
+
+	written := inner.Batches()[0][0]
+	if written.Description.ID() == measure.Description.ID() || written.Value != measure.Value {
+		t.Fatal("relabelled measure must have own description and the same value")
+	}
+}
+
+func TestRelabelCallback(t *testing.T) {
+	inner := &testStorage{id: "prometheus"}
+	s := NewRelabel(inner, DenyNames("go_*"), RenameLabel("path", "handler"))
+
+	s.SetCallback(func() (snitch.Measures, error) {
+		return snitch.Measures{
+			relabelMeasure("http_requests_total", "path", "/api"),
+			relabelMeasure("go_goroutines"),
+		}, nil
+	})
+
+	callback := inner.Callback()
+	if callback == nil {
+		t.Fatal("callback isn't passed to storage")
+	}
+
+	measures, err := callback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := relabelResult(measures); result != "http_requests_total{handler=/api}" {
+		t.Fatalf("callback returned %s", result)
+	}
+
+	s.SetCallback(nil)
+
+	if inner.Callback() != nil {
+		t.Fatal("callback isn't reset")
+	}
+}
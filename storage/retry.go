@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+const (
+	MetricRetryDropped = "snitch_storage_retry_dropped_total"
+	MetricRetryRetried = "snitch_storage_retry_retried_total"
+
+	DefaultRetrySize       = 100
+	DefaultRetryMinBackoff = time.Second
+	DefaultRetryMaxBackoff = time.Minute
+	DefaultRetryJitter     = 0.2
+)
+
+type RetryOption func(*Retry)
+
+type retryBatch struct {
+	seq      uint64
+	measures snitch.Measures
+}
+
+type Retry struct {
+	mutex sync.Mutex
+
+	storage    snitch.Storage
+	queue      []*retryBatch
+	head       int
+	count      int
+	seq        uint64
+	running    bool
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	jitter     float64
+
+	dropped snitch.Counter
+	retried snitch.Counter
+}
+
+func WithRetrySize(size int) RetryOption {
+	return func(s *Retry) {
+		if size > 0 {
+			s.queue = make([]*retryBatch, size)
+		}
+	}
+}
+
+func WithRetryBackoff(min, max time.Duration) RetryOption {
+	return func(s *Retry) {
+		if min > 0 {
+			s.minBackoff = min
+		}
+
+		if max >= s.minBackoff {
+			s.maxBackoff = max
+		}
+	}
+}
+
+func WithRetryJitter(jitter float64) RetryOption {
+	return func(s *Retry) {
+		if jitter >= 0 && jitter <= 1 {
+			s.jitter = jitter
+		}
+	}
+}
+
+// NewRetry wraps the storage, failed batches are queued in memory and written again
+// with exponential backoff, the oldest batches are dropped when the queue is full
+func NewRetry(s snitch.Storage, opts ...RetryOption) *Retry {
+	storage := &Retry{
+		storage:    s,
+		queue:      make([]*retryBatch, DefaultRetrySize),
+		minBackoff: DefaultRetryMinBackoff,
+		maxBackoff: DefaultRetryMaxBackoff,
+		jitter:     DefaultRetryJitter,
+		dropped:    snitch.NewCounter(MetricRetryDropped, "Number of batches dropped because of retry queue overflow", "storage", s.ID()),
+		retried:    snitch.NewCounter(MetricRetryRetried, "Number of retried batches", "storage", s.ID()),
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	return storage
+}
+
+func (s *Retry) ID() string {
+	return s.storage.ID()
+}
+
+func (s *Retry) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+
+	// keep order of batches while the queue is not empty
+	if s.count > 0 {
+		s.push(measures)
+		s.mutex.Unlock()
+
+		return nil
+	}
+
+	s.mutex.Unlock()
+
+	err := s.storage.Write(measures)
+	if err != nil {
+		s.mutex.Lock()
+		s.push(measures)
+		s.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (s *Retry) SetLabels(l snitch.Labels) {
+	s.storage.SetLabels(l)
+}
+
+func (s *Retry) SetCallback(f func() (snitch.Measures, error)) {
+	if rs, ok := s.storage.(snitch.StorageRealtime); ok {
+		rs.SetCallback(f)
+	}
+}
+
+func (s *Retry) SendInterval() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendInterval()
+	}
+
+	return 0
+}
+
+func (s *Retry) SendJitter() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendJitter()
+	}
+
+	return 0
+}
+
+func (s *Retry) Dropped() uint64 {
+	return uint64(s.dropped.Count())
+}
+
+func (s *Retry) Retried() uint64 {
+	return uint64(s.retried.Count())
+}
+
+func (s *Retry) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.count
+}
+
+func (s *Retry) Describe(ch chan<- *snitch.Description) {
+	s.dropped.Describe(ch)
+	s.retried.Describe(ch)
+}
+
+func (s *Retry) Collect(ch chan<- snitch.Metric) {
+	s.dropped.Collect(ch)
+	s.retried.Collect(ch)
+}
+
+// push must be called under the lock
+func (s *Retry) push(measures snitch.Measures) {
+	if s.count == len(s.queue) {
+		s.queue[s.head] = nil
+		s.head = (s.head + 1) % len(s.queue)
+		s.count--
+
+		s.dropped.Inc()
+	}
+
+	s.seq++
+	s.queue[(s.head+s.count)%len(s.queue)] = &retryBatch{
+		seq:      s.seq,
+		measures: measures,
+	}
+	s.count++
+
+	if !s.running {
+		s.running = true
+
+		go s.loop()
+	}
+}
+
+func (s *Retry) loop() {
+	for attempt := 1; ; {
+		s.mutex.Lock()
+
+		if s.count == 0 {
+			s.running = false
+			s.mutex.Unlock()
+
+			return
+		}
+
+		batch := s.queue[s.head]
+		s.mutex.Unlock()
+
+		if attempt > 0 {
+			time.Sleep(s.backoff(attempt))
+		}
+
+		s.retried.Inc()
+
+		if err := s.storage.Write(batch.measures); err != nil {
+			attempt++
+			continue
+		}
+
+		attempt = 0
+
+		s.mutex.Lock()
+
+		// batch could be dropped by overflow while writing
+		if s.count > 0 && s.queue[s.head].seq == batch.seq {
+			s.queue[s.head] = nil
+			s.head = (s.head + 1) % len(s.queue)
+			s.count--
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Retry) backoff(attempt int) time.Duration {
+	d := s.minBackoff
+
+	for i := 1; i < attempt && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+
+	if s.jitter > 0 {
+		d -= time.Duration(float64(d) * s.jitter * rand.Float64())
+	}
+
+	return d
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryOverflow(t *testing.T) {
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+	s := NewRetry(inner, WithRetrySize(2), WithRetryBackoff(20*time.Millisecond, 20*time.Millisecond), WithRetryJitter(0))
+
+	if err := s.Write(testBatch("first")); err == nil {
+		t.Fatal("error of failed write isn't returned")
+	}
+
+	for _, name := range []string{"second", "third", "fourth"} {
+		if err := s.Write(testBatch(name)); err != nil {
+			t.Fatalf("queued write returned error %v", err)
+		}
+	}
+
+	if s.Len() != 2 {
+		t.Fatalf("%d batches in queue, expected 2", s.Len())
+	}
+
+	if s.Dropped() != 2 {
+		t.Fatalf("%d batches dropped, expected 2", s.Dropped())
+	}
+
+	// the loop takes the head of the queue again after the next failed attempt,
+	// so the dropped batch that is in flight now isn't written
+	attempts := inner.Attempts()
+
+	waitFor(t, func() bool {
+		return inner.Attempts() > attempts
+	})
+
+	inner.SetError(nil)
+
+	waitFor(t, func() bool {
+		return s.Len() == 0
+	})
+
+	names := batchNames(inner.Batches())
+	if len(names) != 2 || names[0] != "third" || names[1] != "fourth" {
+		t.Fatalf("written batches %v, expected [third fourth]", names)
+	}
+
+	// every write except the first one is made by the retry loop
+	if retried, expected := s.Retried(), uint64(inner.Attempts()-1); retried != expected {
+		t.Fatalf("%d batches retried, expected %d", retried, expected)
+	}
+}
+
+func TestRetryOrder(t *testing.T) {
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+	s := NewRetry(inner, WithRetryBackoff(10*time.Millisecond, 10*time.Millisecond), WithRetryJitter(0))
+
+	s.Write(testBatch("first"))
+
+	// queue isn't empty, so the batch waits for the previous ones
+	attempts := inner.Attempts()
+
+	if err := s.Write(testBatch("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if inner.Attempts() != attempts {
+		t.Fatal("batch is written while the queue isn't empty")
+	}
+
+	inner.SetError(nil)
+
+	waitFor(t, func() bool {
+		return s.Len() == 0
+	})
+
+	if err := s.Write(testBatch("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if len(names) != 3 || names[0] != "first" || names[1] != "second" || names[2] != "third" {
+		t.Fatalf("written batches %v, expected [first second third]", names)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := NewRetry(&testStorage{id: "influx"}, WithRetryBackoff(time.Second, 10*time.Second), WithRetryJitter(0))
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if d := s.backoff(test.attempt); d != test.expected {
+			t.Fatalf("backoff %s of attempt %d, expected %s", d, test.attempt, test.expected)
+		}
+	}
+
+	s = NewRetry(&testStorage{id: "influx"}, WithRetryBackoff(time.Second, 10*time.Second), WithRetryJitter(0.5))
+
+	for i := 0; i < 100; i++ {
+		if d := s.backoff(100); d < 5*time.Second || d > 10*time.Second {
+			t.Fatalf("backoff %s with jitter is out of [5s, 10s]", d)
+		}
+	}
+}
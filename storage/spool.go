@@ -0,0 +1,505 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+const (
+	SpoolSyncAlways SpoolSyncPolicy = iota
+	SpoolSyncOnRotate
+	SpoolSyncNever
+
+	DefaultSpoolSegmentSize = 8 << 20
+	DefaultSpoolMaxSize     = 256 << 20
+	DefaultSpoolMaxAge      = 24 * time.Hour
+
+	spoolSegmentExt    = ".spool"
+	spoolRecordHeader  = 8
+	spoolMaxRecordSize = 256 << 20
+)
+
+var (
+	errSpoolCorrupted = errors.New("spool record is corrupted")
+)
+
+type SpoolSyncPolicy int
+
+type SpoolOption func(*Spool)
+
+type spoolMeasure struct {
+	Name                 string
+	Help                 string
+	Type                 snitch.MetricType
+	Unit                 string
+	Labels               snitch.Labels
+	DescriptionCreatedAt time.Time
+	CreatedAt            time.Time
+	Value                *snitch.MeasureValue
+}
+
+type spoolSegment struct {
+	seq     uint64
+	path    string
+	size    int64
+	offset  int64
+	modTime time.Time
+}
+
+// Spool wraps the storage and writes batches to it directly while the log is empty,
+// a batch is appended to segmented log on disk only after the storage failed to write it.
+// While the log is not empty, new batches are appended to its end and segments are
+// replayed in order on every write, so batches keep their order once the storage works
+// again. Replayed position is kept in memory only, so after restart a partially replayed
+// segment is delivered again
+type Spool struct {
+	mutex sync.Mutex
+
+	storage     snitch.Storage
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	sync        SpoolSyncPolicy
+
+	segments []*spoolSegment
+	current  *os.File
+	seq      uint64
+}
+
+func WithSpoolSegmentSize(size int64) SpoolOption {
+	return func(s *Spool) {
+		if size > 0 {
+			s.segmentSize = size
+		}
+	}
+}
+
+func WithSpoolMaxSize(size int64) SpoolOption {
+	return func(s *Spool) {
+		if size > 0 {
+			s.maxSize = size
+		}
+	}
+}
+
+func WithSpoolMaxAge(d time.Duration) SpoolOption {
+	return func(s *Spool) {
+		if d > 0 {
+			s.maxAge = d
+		}
+	}
+}
+
+func WithSpoolSync(policy SpoolSyncPolicy) SpoolOption {
+	return func(s *Spool) {
+		s.sync = policy
+	}
+}
+
+func NewSpool(s snitch.Storage, dir string, opts ...SpoolOption) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	storage := &Spool{
+		storage:     s,
+		dir:         dir,
+		segmentSize: DefaultSpoolSegmentSize,
+		maxSize:     DefaultSpoolMaxSize,
+		maxAge:      DefaultSpoolMaxAge,
+		sync:        SpoolSyncAlways,
+	}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	if err := storage.load(); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *Spool) ID() string {
+	return s.storage.ID()
+}
+
+func (s *Spool) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+
+	if len(s.segments) == 0 {
+		err := s.storage.Write(measures)
+		if err == nil {
+			return nil
+		}
+
+		if e := s.append(measures); e != nil {
+			return fmt.Errorf("failed spool measures because %v after write failed because %v", e, err)
+		}
+
+		return err
+	}
+
+	if err := s.append(measures); err != nil {
+		return err
+	}
+
+	return s.replay()
+}
+
+func (s *Spool) SetLabels(l snitch.Labels) {
+	s.storage.SetLabels(l)
+}
+
+func (s *Spool) SetCallback(f func() (snitch.Measures, error)) {
+	if rs, ok := s.storage.(snitch.StorageRealtime); ok {
+		rs.SetCallback(f)
+	}
+}
+
+func (s *Spool) SendInterval() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendInterval()
+	}
+
+	return 0
+}
+
+func (s *Spool) SendJitter() time.Duration {
+	if ss, ok := s.storage.(snitch.StorageScheduled); ok {
+		return ss.SendJitter()
+	}
+
+	return 0
+}
+
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var size int64
+
+	for _, segment := range s.segments {
+		size += segment.size - segment.offset
+	}
+
+	return size
+}
+
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closeCurrent()
+}
+
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != spoolSegmentExt {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, &spoolSegment{
+			seq:     seq,
+			path:    filepath.Join(s.dir, f.Name()),
+			size:    f.Size(),
+			modTime: f.ModTime(),
+		})
+
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	return nil
+}
+
+func (s *Spool) append(measures snitch.Measures) error {
+	record, err := encodeSpoolRecord(measures)
+	if err != nil {
+		return err
+	}
+
+	last := len(s.segments) - 1
+
+	if s.current == nil || s.segments[last].size >= s.segmentSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+
+		last = len(s.segments) - 1
+	}
+
+	n, err := s.current.Write(record)
+	s.segments[last].size += int64(n)
+	s.segments[last].modTime = time.Now()
+
+	if err != nil {
+		return err
+	}
+
+	if s.sync == SpoolSyncAlways {
+		if err = s.current.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.limit()
+
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	segment := &spoolSegment{
+		seq:     s.seq,
+		path:    filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolSegmentExt)),
+		modTime: time.Now(),
+	}
+
+	f, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	s.current = f
+	s.segments = append(s.segments, segment)
+
+	return nil
+}
+
+func (s *Spool) closeCurrent() error {
+	if s.current == nil {
+		return nil
+	}
+
+	var err error
+
+	if s.sync != SpoolSyncNever {
+		err = s.current.Sync()
+	}
+
+	if e := s.current.Close(); err == nil {
+		err = e
+	}
+
+	s.current = nil
+
+	return err
+}
+
+func (s *Spool) replay() error {
+	// new batches must not be appended to the segment being replayed
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+
+		if err := s.replaySegment(segment); err != nil {
+			return err
+		}
+
+		s.remove(0)
+	}
+
+	return nil
+}
+
+func (s *Spool) replaySegment(segment *spoolSegment) error {
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(segment.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+
+	for {
+		measures, n, err := decodeSpoolRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+
+		// the tail of segment can be broken by crash, the rest of segment is skipped
+		if err != nil {
+			return nil
+		}
+
+		if err = s.storage.Write(measures); err != nil {
+			return err
+		}
+
+		segment.offset += n
+	}
+}
+
+func (s *Spool) expire() {
+	if s.maxAge <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-s.maxAge)
+
+	for i := 0; i < len(s.segments); i++ {
+		if s.segments[i].modTime.Before(deadline) && (s.current == nil || i != len(s.segments)-1) {
+			s.remove(i)
+			i--
+		}
+	}
+}
+
+func (s *Spool) limit() {
+	var size int64
+
+	for _, segment := range s.segments {
+		size += segment.size
+	}
+
+	for len(s.segments) > 1 && size > s.maxSize {
+		size -= s.segments[0].size
+		s.remove(0)
+	}
+}
+
+func (s *Spool) remove(i int) {
+	os.Remove(s.segments[i].path)
+	s.segments = append(s.segments[:i], s.segments[i+1:]...)
+}
+
+func encodeSpoolRecord(measures snitch.Measures) ([]byte, error) {
+	records := make([]spoolMeasure, 0, len(measures))
+
+	for _, m := range measures {
+		records = append(records, spoolMeasure{
+			Name:                 m.Description.Name(),
+			Help:                 m.Description.Help(),
+			Type:                 m.Description.Type(),
+			Unit:                 m.Description.Unit(),
+			Labels:               m.Description.Labels(),
+			DescriptionCreatedAt: m.Description.CreatedAt(),
+			CreatedAt:            m.CreatedAt,
+			Value:                m.Value,
+		})
+	}
+
+	var payload bytes.Buffer
+
+	if err := gob.NewEncoder(&payload).Encode(records); err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, spoolRecordHeader+payload.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(record[spoolRecordHeader:], payload.Bytes())
+
+	return record, nil
+}
+
+func decodeSpoolRecord(r io.Reader) (snitch.Measures, int64, error) {
+	header := make([]byte, spoolRecordHeader)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errSpoolCorrupted
+		}
+
+		return nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > spoolMaxRecordSize {
+		return nil, 0, errSpoolCorrupted
+	}
+
+	payload := make([]byte, size)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errSpoolCorrupted
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupted
+	}
+
+	var records []spoolMeasure
+
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&records); err != nil {
+		return nil, 0, errSpoolCorrupted
+	}
+
+	measures := make(snitch.Measures, 0, len(records))
+
+	for _, record := range records {
+		labels := make([]string, 0, len(record.Labels)*2)
+		for _, l := range record.Labels {
+			labels = append(labels, l.Key, l.Value)
+		}
+
+		// records spooled before the time of description was stored have no better start than the measure
+		createdAt := record.DescriptionCreatedAt
+		if createdAt.IsZero() {
+			createdAt = record.CreatedAt
+		}
+
+		description := snitch.NewDescriptionWithCreatedAt(record.Name, record.Help, record.Type, createdAt, labels...)
+
+		// records spooled before the unit was stored keep the unit taken from name
+		if record.Unit != "" && record.Unit != description.Unit() {
+			description = description.WithUnit(record.Unit)
+		}
+
+		measures = append(measures, &snitch.Measure{
+			Description: description,
+			CreatedAt:   record.CreatedAt,
+			Value:       record.Value,
+		})
+	}
+
+	return measures, int64(spoolRecordHeader) + int64(size), nil
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func TestSpoolRecordRoundTrip(t *testing.T) {
+	createdAt := time.Now().Add(-time.Hour).Round(0)
+	description := snitch.NewDescriptionWithCreatedAt("requests_total", "Requests", snitch.MetricTypeCounter, createdAt, "code", "200").WithUnit("requests")
+
+	measures := snitch.Measures{
+		&snitch.Measure{
+			Description: description,
+			CreatedAt:   time.Now().Round(0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(42),
+				SampleCount: snitch.Uint64(42),
+				Quantiles: map[float64]*float64{
+					0.5: snitch.Float64(1.5),
+				},
+			},
+		},
+	}
+
+	record, err := encodeSpoolRecord(measures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, n, err := decodeSpoolRecord(bytes.NewReader(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(record)) {
+		t.Fatalf("read %d bytes of %d", n, len(record))
+	}
+
+	if len(decoded) != 1 {
+		t.Fatalf("decoded %d measures", len(decoded))
+	}
+
+	m := decoded[0]
+
+	if m.Description.Name() != "requests_total" || m.Description.Help() != "Requests" || m.Description.Type() != snitch.MetricTypeCounter {
+		t.Fatalf("unexpected description %s %s %s", m.Description.Name(), m.Description.Help(), m.Description.Type())
+	}
+
+	if m.Description.Unit() != "requests" {
+		t.Fatalf("unit %q, expected requests", m.Description.Unit())
+	}
+
+	if m.Description.Labels().String() != description.Labels().String() {
+		t.Fatalf("labels %s, expected %s", m.Description.Labels(), description.Labels())
+	}
+
+	if !m.Description.CreatedAt().Equal(createdAt) {
+		t.Fatalf("description created at %s, expected %s", m.Description.CreatedAt(), createdAt)
+	}
+
+	if !m.CreatedAt.Equal(measures[0].CreatedAt) {
+		t.Fatalf("measure created at %s, expected %s", m.CreatedAt, measures[0].CreatedAt)
+	}
+
+	if *m.Value.Value != 42 || *m.Value.SampleCount != 42 || *m.Value.Quantiles[0.5] != 1.5 {
+		t.Fatalf("unexpected value %+v", m.Value)
+	}
+}
+
+func TestSpoolRecordCorrupted(t *testing.T) {
+	record, err := encodeSpoolRecord(snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescription("gauge", "", snitch.MetricTypeGauge),
+			CreatedAt:   time.Now(),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(1),
+				SampleCount: snitch.Uint64(1),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record[len(record)-1] ^= 0xff
+
+	if _, _, err = decodeSpoolRecord(bytes.NewReader(record)); err != errSpoolCorrupted {
+		t.Fatalf("expected corrupted record, got %v", err)
+	}
+}
+
+// flakyStorage fails to write batches with the names
+type flakyStorage struct {
+	*testStorage
+
+	fail map[string]bool
+}
+
+func (s *flakyStorage) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	failed := s.fail[measures[0].Description.Name()]
+	s.mutex.Unlock()
+
+	if failed {
+		return errors.New("unavailable")
+	}
+
+	return s.testStorage.Write(measures)
+}
+
+func (s *flakyStorage) SetFail(names ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.fail = make(map[string]bool, len(names))
+
+	for _, name := range names {
+		s.fail[name] = true
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+
+	s, err := NewSpool(inner, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = s.Write(testBatch("first")); err == nil {
+		t.Fatal("error of failed write isn't returned")
+	}
+
+	if s.Size() == 0 {
+		t.Fatal("failed batch isn't appended to log")
+	}
+
+	attempts := inner.Attempts()
+
+	// the batch is appended to the log before replay, so it follows the first one
+	if err = s.Write(testBatch("second")); err == nil {
+		t.Fatal("error of failed replay isn't returned")
+	}
+
+	if inner.Attempts() != attempts+1 {
+		t.Fatalf("%d writes while replay, expected only the first batch", inner.Attempts()-attempts)
+	}
+
+	inner.SetError(nil)
+
+	if err = s.Write(testBatch("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Size() != 0 {
+		t.Fatalf("%d bytes left in log after replay", s.Size())
+	}
+
+	if err = s.Write(testBatch("fourth")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if strings.Join(names, ",") != "first,second,third,fourth" {
+		t.Fatalf("written batches %v, expected [first second third fourth]", names)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt)); len(files) != 0 {
+		t.Fatalf("replayed segments %v aren't removed", files)
+	}
+}
+
+func TestSpoolResumeReplay(t *testing.T) {
+	inner := &flakyStorage{testStorage: &testStorage{id: "influx"}}
+	inner.SetFail("first", "second", "third")
+
+	s, err := NewSpool(inner, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"first", "second", "third"} {
+		s.Write(testBatch(name))
+	}
+
+	// replay stops at the second batch
+	inner.SetFail("second")
+
+	if err = s.Write(testBatch("fourth")); err == nil {
+		t.Fatal("error of partial replay isn't returned")
+	}
+
+	inner.SetFail()
+
+	if err = s.Write(testBatch("fifth")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if strings.Join(names, ",") != "first,second,third,fourth,fifth" {
+		t.Fatalf("written batches %v, expected each batch once in order", names)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	record, err := encodeSpoolRecord(testBatch("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+
+	// every batch gets own segment and only two of them fit
+	s, err := NewSpool(inner, t.TempDir(), WithSpoolSegmentSize(1), WithSpoolMaxSize(int64(5*len(record)/2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		s.Write(testBatch(name))
+	}
+
+	if len(s.segments) != 2 {
+		t.Fatalf("%d segments in log, expected 2", len(s.segments))
+	}
+
+	// the new batch is appended before replay, so one more segment is dropped
+	inner.SetError(nil)
+
+	if err = s.Write(testBatch("fifth")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if strings.Join(names, ",") != "fourth,fifth" {
+		t.Fatalf("written batches %v, expected [fourth fifth]", names)
+	}
+}
+
+func TestSpoolExpire(t *testing.T) {
+	inner := &testStorage{id: "influx", err: errors.New("unavailable")}
+
+	s, err := NewSpool(inner, t.TempDir(), WithSpoolMaxAge(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write(testBatch("first"))
+	s.Write(testBatch("second"))
+
+	time.Sleep(60 * time.Millisecond)
+	inner.SetError(nil)
+
+	if err = s.Write(testBatch("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if strings.Join(names, ",") != "third" {
+		t.Fatalf("written batches %v, expected expired batches to be dropped", names)
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewSpool(&testStorage{id: "influx", err: errors.New("unavailable")}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Write(testBatch("first"))
+	s.Write(testBatch("second"))
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &testStorage{id: "influx"}
+
+	if s, err = NewSpool(inner, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Size() == 0 {
+		t.Fatal("segments aren't loaded")
+	}
+
+	if err = s.Write(testBatch("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := batchNames(inner.Batches())
+	if strings.Join(names, ",") != "first,second,third" {
+		t.Fatalf("written batches %v, expected [first second third]", names)
+	}
+}
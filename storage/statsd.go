@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kihamo/snitch"
+	"github.com/pborman/uuid"
+)
+
+const (
+	DefaultStatsDPacketSize = 1432
+
+	// counters missed in so many writes in a row are forgotten
+	statsDStaleWrites = 10
+)
+
+var (
+	statsDNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	statsDTagReplacer  = strings.NewReplacer("|", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+// StatsD sends measures to StatsD or DogStatsD agent over UDP. Counters are sent as
+// deltas of cumulative value since the previous write, other values as gauges.
+// Without DogStatsD labels are appended to the name as .key.value pairs
+type StatsD struct {
+	mutex sync.RWMutex
+
+	id         string
+	address    string
+	prefix     string
+	dogStatsD  bool
+	packetSize int
+	labels     snitch.Labels
+	previous   map[string]statsDCounter
+	writes     uint64
+}
+
+type statsDCounter struct {
+	value float64
+	write uint64
+}
+
+func NewStatsD(address, prefix string, dogStatsD bool) (*StatsD, error) {
+	return NewStatsDWithID("", address, prefix, dogStatsD)
+}
+
+func NewStatsDWithID(id, address, prefix string, dogStatsD bool) (*StatsD, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+
+	storage := &StatsD{
+		id:       id,
+		previous: make(map[string]statsDCounter),
+	}
+
+	err := storage.Reinitialization(address, prefix, dogStatsD, DefaultStatsDPacketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *StatsD) ID() string {
+	return s.id
+}
+
+func (s *StatsD) Write(measures snitch.Measures) error {
+	s.mutex.RLock()
+	address, prefix, dogStatsD, packetSize := s.address, s.prefix, s.dogStatsD, s.packetSize
+	globalLabels := s.labels
+	s.mutex.RUnlock()
+
+	lines := make([]string, 0, len(measures))
+
+	defer s.prune()
+
+	for _, m := range measures {
+		labels := mergeLabels(globalLabels, m.Description.Labels())
+		name := prefix + statsDNameReplacer.Replace(m.Description.Name())
+
+		var tags string
+
+		if dogStatsD {
+			tags = statsDTags(labels)
+		} else {
+			for _, l := range labels {
+				name += "." + sanitizeGraphiteNode(l.Key) + "." + sanitizeGraphiteNode(l.Value)
+			}
+		}
+
+		switch m.Description.Type() {
+		case snitch.MetricTypeCounter, snitch.MetricTypeMeter:
+			// NaN and infinite values are neither sent nor kept as previous, so next deltas are not broken
+			if value := *(m.Value.Value); !math.IsNaN(value) && !math.IsInf(value, 0) {
+				if delta := s.delta(m.Description.Name()+"{"+labels.String()+"}", value); delta != 0 {
+					lines = append(lines, name+":"+formatStatsDValue(delta)+"|c"+tags)
+				}
+			}
+
+			if m.Description.Type() == snitch.MetricTypeCounter {
+				continue
+			}
+
+			for _, field := range measureFields(m)[1:] {
+				lines = append(lines, statsDGauge(name+"."+field.suffix, field.value, tags)...)
+			}
+
+		default:
+			if *(m.Value.SampleCount) == 0 {
+				continue
+			}
+
+			for _, field := range measureFields(m) {
+				path := name
+				if field.suffix != "" {
+					path += "." + field.suffix
+				}
+
+				lines = append(lines, statsDGauge(path, field.value, tags)...)
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > packetSize {
+			if _, err = conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+
+		buf.WriteString(line)
+	}
+
+	_, err = conn.Write(buf.Bytes())
+
+	return err
+}
+
+func (s *StatsD) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *StatsD) Reinitialization(address, prefix string, dogStatsD bool, packetSize int) error {
+	if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+		return err
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	if packetSize <= 0 {
+		packetSize = DefaultStatsDPacketSize
+	}
+
+	s.mutex.Lock()
+	s.address = address
+	s.prefix = prefix
+	s.dogStatsD = dogStatsD
+	s.packetSize = packetSize
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *StatsD) delta(key string, value float64) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, ok := s.previous[key]
+	s.previous[key] = statsDCounter{
+		value: value,
+		write: s.writes,
+	}
+
+	// counter was recreated, so whole value is new
+	if !ok || value < previous.value {
+		return value
+	}
+
+	return value - previous.value
+}
+
+// prune forgets counters of unregistered metrics, counters of collectors missed
+// in a few writes because of timeout are kept to not send whole value again
+func (s *StatsD) prune() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.writes++
+
+	if s.writes <= statsDStaleWrites {
+		return
+	}
+
+	for key, counter := range s.previous {
+		if counter.write < s.writes-statsDStaleWrites {
+			delete(s.previous, key)
+		}
+	}
+}
+
+func statsDGauge(name string, value float64, tags string) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+
+	// leading sign means relative change of gauge, so negative value must be set from zero
+	if value < 0 {
+		return []string{
+			name + ":0|g" + tags,
+			name + ":" + formatStatsDValue(value) + "|g" + tags,
+		}
+	}
+
+	return []string{name + ":" + formatStatsDValue(value) + "|g" + tags}
+}
+
+func statsDTags(labels snitch.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	tags := make([]string, 0, len(labels))
+
+	for _, l := range labels {
+		tags = append(tags, statsDTagReplacer.Replace(l.Key)+":"+statsDTagReplacer.Replace(l.Value))
+	}
+
+	return "|#" + strings.Join(tags, ",")
+}
+
+func formatStatsDValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
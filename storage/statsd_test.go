@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+func TestStatsDCounterDelta(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), "app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := snitch.NewCounter("requests_total", "", "code", "200")
+	counter.Add(5)
+
+	if err = s.Write(testMeasures(counter)); err != nil {
+		t.Fatal(err)
+	}
+
+	counter.Add(3)
+
+	if err = s.Write(testMeasures(counter)); err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged counter sends nothing
+	if err = s.Write(testMeasures(counter)); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readUDP(t, conn)
+	expected := []string{
+		"app.requests_total.code.200:5|c",
+		"app.requests_total.code.200:3|c",
+	}
+
+	if strings.Join(packets, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("packets %q, expected %q", packets, expected)
+	}
+}
+
+func TestStatsDCounterNaN(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	description := snitch.NewDescription("errors_total", "", snitch.MetricTypeCounter)
+	write := func(v float64) {
+		if err := s.Write(snitch.Measures{
+			&snitch.Measure{
+				Description: description,
+				CreatedAt:   time.Now(),
+				Value: &snitch.MeasureValue{
+					Value:       snitch.Float64(v),
+					SampleCount: snitch.Uint64(1),
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(2)
+	write(math.NaN())
+	write(5)
+
+	packets := readUDP(t, conn)
+	expected := []string{
+		"errors_total:2|c",
+		"errors_total:3|c",
+	}
+
+	if strings.Join(packets, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("packets %q, expected %q", packets, expected)
+	}
+}
+
+func TestStatsDPrune(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := snitch.NewCounter("requests_total", "")
+	counter.Inc()
+
+	if err = s.Write(testMeasures(counter)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= statsDStaleWrites; i++ {
+		if err = s.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(s.previous) != 0 {
+		t.Fatalf("stale counters are kept: %v", s.previous)
+	}
+}
+
+func TestStatsDDogStatsDTags(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLabels(snitch.Labels{{Key: "env", Value: "prod"}})
+
+	gauge := snitch.NewGauge("temperature", "", "room", "living room")
+	gauge.Set(-2.5)
+
+	if err = s.Write(testMeasures(gauge)); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readUDP(t, conn)
+	expected := "temperature:0|g|#env:prod,room:living_room\ntemperature:-2.5|g|#env:prod,room:living_room"
+
+	if len(packets) != 1 || packets[0] != expected {
+		t.Fatalf("packets %q, expected %q", packets, expected)
+	}
+}
+
+func TestStatsDPacketSize(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Reinitialization(conn.LocalAddr().String(), "", false, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make([]snitch.Metric, 0, 10)
+
+	for i := 0; i < 10; i++ {
+		gauge := snitch.NewGauge("gauge_with_long_name", "", "index", string(rune('a'+i)))
+		gauge.Set(float64(i))
+
+		metrics = append(metrics, gauge)
+	}
+
+	if err = s.Write(testMeasures(metrics...)); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readUDP(t, conn)
+	if len(packets) < 2 {
+		t.Fatalf("lines are not split by packet size: %q", packets)
+	}
+
+	lines := 0
+
+	for _, packet := range packets {
+		if len(packet) > 64 {
+			t.Fatalf("packet of %d bytes exceeds packet size", len(packet))
+		}
+
+		lines += len(strings.Split(packet, "\n"))
+	}
+
+	if lines != 10 {
+		t.Fatalf("received %d lines, expected 10", lines)
+	}
+}
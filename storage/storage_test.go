@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kihamo/snitch"
+)
+
+// testStorage records written batches and fails while the error is set
+type testStorage struct {
+	mutex sync.Mutex
+
+	id       string
+	err      error
+	attempts int
+	batches  []snitch.Measures
+	labels   snitch.Labels
+	callback func() (snitch.Measures, error)
+}
+
+func (s *testStorage) ID() string {
+	return s.id
+}
+
+func (s *testStorage) Write(measures snitch.Measures) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attempts++
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.batches = append(s.batches, measures)
+
+	return nil
+}
+
+func (s *testStorage) SetLabels(l snitch.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = l
+}
+
+func (s *testStorage) SetCallback(f func() (snitch.Measures, error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.callback = f
+}
+
+func (s *testStorage) SetError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+}
+
+func (s *testStorage) Attempts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.attempts
+}
+
+func (s *testStorage) Batches() []snitch.Measures {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]snitch.Measures(nil), s.batches...)
+}
+
+func (s *testStorage) Callback() func() (snitch.Measures, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.callback
+}
+
+// testMeasures returns measures of the metrics created at the fixed time
+func testMeasures(metrics ...snitch.Metric) snitch.Measures {
+	measures := make(snitch.Measures, 0, len(metrics))
+
+	for _, metric := range metrics {
+		value, _ := metric.Measure()
+
+		measures = append(measures, &snitch.Measure{
+			Description: metric.Description(),
+			CreatedAt:   time.Unix(100, 0).UTC(),
+			Value:       value,
+		})
+	}
+
+	return measures
+}
+
+// testBatch returns batch of single gauge with the name
+func testBatch(name string) snitch.Measures {
+	return snitch.Measures{
+		&snitch.Measure{
+			Description: snitch.NewDescription(name, "", snitch.MetricTypeGauge),
+			CreatedAt:   time.Unix(100, 0),
+			Value: &snitch.MeasureValue{
+				Value:       snitch.Float64(1),
+				SampleCount: snitch.Uint64(1),
+			},
+		},
+	}
+}
+
+func batchNames(batches []snitch.Measures) []string {
+	names := make([]string, 0, len(batches))
+
+	for _, batch := range batches {
+		names = append(names, batch[0].Description.Name())
+	}
+
+	return names
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// readStatsD returns packets received until nothing is sent for a while
+func readUDP(t *testing.T, conn net.PacketConn) []string {
+	packets := make([]string, 0)
+	buf := make([]byte, 65536)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return packets
+			}
+
+			t.Fatal(err)
+		}
+
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// waitFor polls the condition until it is true or the second is passed
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition isn't met in time")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWrappersScheduled(t *testing.T) {
+	spool, err := NewSpool(snitch.NewScheduledStorage(&testStorage{id: "scheduled"}, time.Minute, time.Second), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	plainSpool, err := NewSpool(&testStorage{id: "plain"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainSpool.Close()
+
+	scheduled := func() snitch.Storage {
+		return snitch.NewScheduledStorage(&testStorage{id: "scheduled"}, time.Minute, time.Second)
+	}
+
+	tests := []struct {
+		name     string
+		storage  snitch.Storage
+		interval time.Duration
+		jitter   time.Duration
+	}{
+		{"retry", NewRetry(scheduled()), time.Minute, time.Second},
+		{"retry plain", NewRetry(&testStorage{id: "plain"}), 0, 0},
+		{"circuit breaker", NewCircuitBreaker(scheduled()), time.Minute, time.Second},
+		{"circuit breaker plain", NewCircuitBreaker(&testStorage{id: "plain"}), 0, 0},
+		{"spool", spool, time.Minute, time.Second},
+		{"spool plain", plainSpool, 0, 0},
+		{"relabel", NewRelabel(scheduled()), time.Minute, time.Second},
+		{"relabel plain", NewRelabel(&testStorage{id: "plain"}), 0, 0},
+		{"nested", NewRetry(NewCircuitBreaker(scheduled())), time.Minute, time.Second},
+	}
+
+	for _, test := range tests {
+		ss, ok := test.storage.(snitch.StorageScheduled)
+		if !ok {
+			t.Fatalf("%s doesn't implement scheduled storage", test.name)
+		}
+
+		if ss.SendInterval() != test.interval || ss.SendJitter() != test.jitter {
+			t.Fatalf("%s has interval %s and jitter %s, expected %s and %s",
+				test.name, ss.SendInterval(), ss.SendJitter(), test.interval, test.jitter)
+		}
+	}
+}
@@ -48,6 +48,31 @@ func NewTimerWithQuantiles(name, help string, quantiles []float64, labels ...str
 	return metric
 }
 
+func NewTimerWithWindow(name, help string, maxAge time.Duration, ageBuckets int, labels ...string) Timer {
+	if maxAge <= 0 {
+		maxAge = DefMaxAge
+	}
+
+	if ageBuckets <= 0 {
+		ageBuckets = DefAgeBuckets
+	}
+
+	metric := &timerMetric{
+		histogramMetric: histogramMetric{
+			description: NewDescription(name, help, MetricTypeTimer, labels...),
+			histogram:   internal.NewSafeHistogram(),
+			window:      internal.NewWindowHistogram(maxAge, ageBuckets),
+			quantiles:   Quantiles,
+		},
+		begin: time.Now(),
+	}
+	metric.SetMetric(metric).SetCreator(func(l ...string) Metric {
+		return NewTimerWithWindow(name, help, maxAge, ageBuckets, append(labels, l...)...)
+	})
+
+	return metric
+}
+
 func (t *timerMetric) Update(d time.Duration) {
 	t.Add(d.Seconds())
 }